@@ -2,16 +2,22 @@ package artifact
 
 import (
 	"context"
-	"encoding/json"
+	"crypto"
 	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
+	"sync"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	storageClient "github.com/menderartifactsconsumer/internal/azblob"
 	"github.com/menderartifactsconsumer/internal/config"
+	"github.com/menderartifactsconsumer/internal/event"
+	"github.com/menderartifactsconsumer/internal/failure"
 	"github.com/menderartifactsconsumer/internal/http"
+	"github.com/menderartifactsconsumer/internal/jobs"
+	"github.com/menderartifactsconsumer/internal/menderartifact"
+	"github.com/menderartifactsconsumer/internal/publisher"
 	nats "github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
 )
@@ -22,9 +28,12 @@ type Request struct {
 	Domain    string `json:"domain"`
 }
 
+// Artifact names the blob to upload. Checksum is the optional hex encoded
+// SHA-256 checksum the whole blob must have.
 type Artifact struct {
 	ContainerName string `json:"containerName"`
 	BlobName      string `json:"blobName"`
+	Checksum      string `json:"checksum,omitempty"`
 }
 
 type UploadArtifactRequest struct {
@@ -38,75 +47,119 @@ type GenerateSASTokenRequest struct {
 	BlobName      string `json:"blobName"`
 }
 
-type UploadArtifactConsumerResponse struct {
-	RequestId    string `json:"requestId"`
-	UploadStatus string `json:"uploadStatus"`
+// UploadArtifactResult is the data of upload.completed events. Artifact is
+// only set when artifacts are validated.
+type UploadArtifactResult struct {
+	Domain           string                   `json:"domain"`
+	ContainerName    string                   `json:"containerName"`
+	BlobName         string                   `json:"blobName"`
+	MenderStatusCode int                      `json:"menderStatusCode"`
+	Artifact         *menderartifact.Metadata `json:"artifact,omitempty"`
 }
 
-type UploadArtifactTargetApplicationResponse struct {
-	RequestId    string `json:"requestId"`
-	UploadStatus string `json:"uploadStatus"`
+// streamResult is the outcome of streaming an artifact to Mender.
+type streamResult struct {
+	metadata *menderartifact.Metadata
+	err      error
 }
 
-func ParseUploadArtifactRequest(msg jetstream.Msg) (*UploadArtifactRequest, error) {
-	var request UploadArtifactRequest
-	err := json.Unmarshal(msg.Data(), &request)
-	if err != nil {
-		log.Printf("Failed to parse credentials: %v", err)
-		return nil, err
-	}
-	return &request, nil
+// Uploader streams artifacts from blob storage to Mender and keeps track of
+// the running uploads so they can be cancelled.
+type Uploader struct {
+	publisher     *publisher.Publisher
+	serviceClient *azblob.Client
+	jobs          *jobs.Store
+	keyring       *keyring
+	keyProvider   KeyProvider
+	signDomains   map[string]bool
+	cfg           *config.Config
+
+	mu      sync.Mutex
+	running map[string]context.CancelCauseFunc
 }
 
-func ParseGenerateSASRequest(msg jetstream.Msg) (*GenerateSASTokenRequest, error) {
-	var request GenerateSASTokenRequest
-	err := json.Unmarshal(msg.Data(), &request)
-
+// NewUploader loads the public keys artifact signatures are verified with
+// and creates the key provider of the signing domains, if any.
+func NewUploader(pub *publisher.Publisher, serviceClient *azblob.Client, jobStore *jobs.Store, cfg *config.Config) (*Uploader, error) {
+	keys, err := loadKeyring(cfg.Artifact.Signature)
 	if err != nil {
-		log.Printf("Failed to parse generatesas request: %v", err)
+		return nil, fmt.Errorf("load artifact signature keys: %w", err)
 	}
-
-	return &request, nil
+	u := &Uploader{
+		publisher:     pub,
+		serviceClient: serviceClient,
+		jobs:          jobStore,
+		keyring:       keys,
+		cfg:           cfg,
+		signDomains:   make(map[string]bool),
+		running:       make(map[string]context.CancelCauseFunc),
+	}
+	if signing := cfg.Artifact.Signing; len(signing.Domains) > 0 {
+		provider, err := newKeyProvider(signing)
+		if err != nil {
+			return nil, fmt.Errorf("set up artifact signing: %w", err)
+		}
+		u.keyProvider = provider
+		for _, domain := range signing.Domains {
+			u.signDomains[domain] = true
+		}
+	}
+	return u, nil
 }
 
-func UploadArtifact(ctx context.Context, js jetstream.JetStream, msg jetstream.Msg, serviceClient *azblob.Client, cfg *config.Config) (string, error) {
-	log.Print(string(msg.Data()))
-	request, err := ParseUploadArtifactRequest(msg)
-	if err != nil {
-		log.Printf("Failed to parse credentials: %v", err)
-		return "", err
-	}
+func (u *Uploader) UploadArtifact(ctx context.Context, msg jetstream.Msg, request *UploadArtifactRequest) (response *nats.Msg, err error) {
+	stopHeartbeat := KeepAlive(ctx, msg, u.cfg.Consumer.HeartbeatInterval())
+	defer stopHeartbeat()
 
-	uploadArtifactConsumerResponse := UploadArtifactConsumerResponse{
-		RequestId:    request.AuthRequest.RequestId,
-		UploadStatus: "In Progress",
-	}
+	ctx, untrack := u.track(ctx, request.AuthRequest.RequestId)
+	defer untrack()
 
-	consumerResponseJson, _ := json.Marshal(uploadArtifactConsumerResponse)
-	responseMsg := nats.NewMsg("artifact.uploadArtifactResponse." + request.AuthRequest.RequestId)
-	responseMsg.Header.Set("StatusCode", "200")
-	responseMsg.Data = append(responseMsg.Data, consumerResponseJson...)
-	fmt.Println(responseMsg.Header.Get("StatusCode"))
-	_, err = js.PublishMsgAsync(responseMsg)
-	log.Print(err)
-	if err != nil {
-		log.Printf("Failed to publish : %v", err)
-	}
+	var menderStatusCode int
+	defer func() {
+		u.recordOutcome(ctx, request, menderStatusCode, err)
+	}()
 
-	log.Print(request.AuthRequest.Domain)
-	log.Printf("Received Request: %s", request.AuthRequest.RequestId)
+	started := event.New(request.AuthRequest.RequestId, event.TypeUploadStarted, event.StatusInProgress)
+	publishEvent(ctx, u.publisher, started.Msg("artifact.uploadArtifactResponse."+request.AuthRequest.RequestId, http.StatusOK))
+
+	log.Printf("Received Request: %s for %s", request.AuthRequest.RequestId, request.AuthRequest.Domain)
 	token := request.AuthRequest.Token
-	msg.Ack()
-	downloadResponse, err := serviceClient.DownloadStream(ctx, request.BlobMetadata.ContainerName, request.BlobMetadata.BlobName, nil)
+	checksum := request.BlobMetadata.Checksum
+	if checksum != "" && !validChecksum(checksum) {
+		return nil, failure.Permanent(failure.CodeInvalidRequest, fmt.Errorf("checksum %q is not a SHA-256 checksum", checksum))
+	}
+	opts := u.keyring.options(request.AuthRequest.Domain)
+	if u.signDomains[request.AuthRequest.Domain] {
+		if opts.Signer, err = u.signingKey(ctx, request.AuthRequest.Domain); err != nil {
+			return nil, err
+		}
+	}
+	u.transition(ctx, request, jobs.StateDownloading, func(job *jobs.Job) {
+		job.Attempts++
+	})
+	downloadResponse, err := u.serviceClient.DownloadStream(ctx, request.BlobMetadata.ContainerName, request.BlobMetadata.BlobName, nil)
 	if err != nil {
 		log.Printf("Failed to start blob download: %v", err)
-		return "", err
+		return u.cancelledOr(ctx, request, downloadError(err))
 	}
 
 	reader, writer := io.Pipe()
 	multipartWriter := multipart.NewWriter(writer)
 
+	// Closing the pipe on cancellation unblocks both the copy below and the
+	// Mender request reading from it.
+	stopCloseOnCancel := context.AfterFunc(ctx, func() {
+		writer.CloseWithError(context.Cause(ctx))
+	})
+	defer stopCloseOnCancel()
+
+	// streamed receives the metadata of the artifact, or why it could not be
+	// streamed so that an invalid artifact is reported instead of the aborted
+	// Mender request.
+	streamed := make(chan streamResult, 1)
 	go func() {
+		var result streamResult
+		defer func() { streamed <- result }()
 		defer writer.Close()
 		defer downloadResponse.Body.Close()
 
@@ -130,8 +183,25 @@ func UploadArtifact(ctx context.Context, js jetstream.JetStream, msg jetstream.M
 			return
 		}
 
-		if _, err = io.Copy(artifactPart, downloadResponse.Body); err != nil {
+		var totalBytes int64
+		if downloadResponse.ContentLength != nil {
+			totalBytes = *downloadResponse.ContentLength
+		}
+		var blob io.Reader = downloadResponse.Body
+		if checksum != "" {
+			blob = newChecksumReader(blob, checksum)
+		}
+		body := newProgressReader(blob, request.AuthRequest.RequestId, totalBytes,
+			u.cfg.Progress.Interval, u.cfg.Progress.PercentStep, publishProgress(u.publisher))
+
+		if u.cfg.Artifact.Validate || opts.Signer != nil {
+			result.metadata, err = menderartifact.Copy(artifactPart, body, opts)
+		} else {
+			_, err = io.Copy(artifactPart, body)
+		}
+		if err != nil {
 			log.Printf("Failed to copy blob data to form file: %v", err)
+			result.err = err
 			writer.CloseWithError(err)
 			return
 		}
@@ -148,41 +218,78 @@ func UploadArtifact(ctx context.Context, js jetstream.JetStream, msg jetstream.M
 	req, err := http.NewRequestWithContext(ctx, "POST", apiURL, reader)
 	if err != nil {
 		log.Printf("Failed to create request: %v", err)
-		return "", err
+		reader.CloseWithError(err)
+		<-streamed
+		return nil, failure.Permanent(failure.CodeInvalidRequest, err)
 	}
 
 	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
 	req.Header.Set("Authorization", "Bearer "+token)
 	log.Print("Sending request")
+	u.transition(ctx, request, jobs.StateUploading, nil)
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Printf("Failed to send request: %v", err)
-		return "", err
+		reader.CloseWithError(err)
+		if err := artifactError((<-streamed).err); err != nil {
+			return nil, err
+		}
+		return u.cancelledOr(ctx, request, failure.Transient(failure.CodeMenderUnreachable, fmt.Errorf("send request to mender: %w", err)))
 	}
 	defer resp.Body.Close()
 
 	responseBody, _ := io.ReadAll(resp.Body)
 	log.Print(string(responseBody))
 	log.Printf("StatusCode: %v", resp.StatusCode)
+	menderStatusCode = resp.StatusCode
 
-	uploadArtifactTargetApplicationResponse := UploadArtifactTargetApplicationResponse{
-		RequestId:    request.AuthRequest.RequestId,
-		UploadStatus: "Finished",
+	// Mender may answer before the body was sent completely.
+	reader.CloseWithError(errResponseReceived)
+	stream := <-streamed
+	if err := artifactError(stream.err); err != nil {
+		return nil, err
 	}
 
-	targetApplicationResponseJson, _ := json.Marshal(uploadArtifactTargetApplicationResponse)
-	targetApplicationresponseMsg := nats.NewMsg("artifact.uploadArtifactTargetApplicationResponse." + request.AuthRequest.RequestId)
-	targetApplicationresponseMsg.Header.Set("StatusCode", string(resp.StatusCode))
-	targetApplicationresponseMsg.Data = append(responseMsg.Data, targetApplicationResponseJson...)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, menderError(resp.StatusCode, responseBody)
+	}
 
-	fmt.Println(responseMsg.Header.Get("StatusCode"))
-	_, err = js.PublishMsgAsync(responseMsg)
-	log.Print(err)
+	completed := event.New(request.AuthRequest.RequestId, event.TypeUploadCompleted, event.StatusCompleted).
+		WithData(UploadArtifactResult{
+			Domain:           request.AuthRequest.Domain,
+			ContainerName:    request.BlobMetadata.ContainerName,
+			BlobName:         request.BlobMetadata.BlobName,
+			MenderStatusCode: resp.StatusCode,
+			Artifact:         stream.metadata,
+		})
+	return u.publishResult(ctx, request, completed, resp.StatusCode), nil
+}
+
+// signingKey returns the key the artifacts of domain are signed with.
+func (u *Uploader) signingKey(ctx context.Context, domain string) (crypto.Signer, error) {
+	signer, err := u.keyProvider.SigningKey(ctx, domain)
 	if err != nil {
-		log.Printf("Failed to publish : %v", err)
+		log.Printf("Failed to get signing key for %s: %v", domain, err)
+		return nil, failure.Transient(failure.CodeSigningFailed, fmt.Errorf("get signing key: %w", err))
+	}
+	return signer, nil
+}
+
+// publishResult publishes the final event of an upload on its target
+// application response subject, and on the reply subject of ctx, and returns
+// the published message.
+func (u *Uploader) publishResult(ctx context.Context, request *UploadArtifactRequest, e event.Event, statusCode int) *nats.Msg {
+	resultMsg := e.Msg("artifact.uploadArtifactTargetApplicationResponse."+request.AuthRequest.RequestId, statusCode)
+	if err := u.publisher.Respond(ctx, resultMsg); err != nil {
+		log.Printf("Failed to publish %s: %v", resultMsg.Subject, err)
 	}
+	return resultMsg
+}
 
-	return "Blob uploaded successfully", nil
+func publishEvent(ctx context.Context, pub *publisher.Publisher, msg *nats.Msg) {
+	if err := pub.Publish(ctx, msg); err != nil {
+		log.Printf("Failed to publish %s: %v", msg.Subject, err)
+	}
 }
 
 // func UploadArtifact(ctx context.Context, js jetstream.JetStream, msg jetstream.Msg, serviceClient *azblob.Client, cfg *config.Config) (string, error) {
@@ -329,32 +436,19 @@ func UploadArtifact(ctx context.Context, js jetstream.JetStream, msg jetstream.M
 // 	return "Blob uploaded successfully", nil
 // }
 
-func GenerateNewSASToken(ctx context.Context, js jetstream.JetStream, msg jetstream.Msg, serviceClient *azblob.Client, cfg *config.Config) (string, error) {
-	request, err := ParseGenerateSASRequest(msg)
-
-	if err != nil {
-		log.Printf("Failed to parse request GenerateNewSasToken")
-		return "", err
-	}
-
+func GenerateNewSASToken(ctx context.Context, pub *publisher.Publisher, msg jetstream.Msg, request *GenerateSASTokenRequest, serviceClient *azblob.Client, cfg *config.Config) (string, error) {
 	log.Print(request.ContainerName)
 	token, err := storageClient.CreateSASToken(cfg, request.ContainerName, request.BlobName)
 
 	if err != nil {
 		log.Printf("Failed to create sas token : %v", err)
-		return "", err
+		return "", SASTokenError(err)
 	}
 
-	tokenJson, _ := json.Marshal(*token)
-
-	responseMsg := nats.NewMsg("artifact.createSASTokenResponse." + request.RequestId)
-	responseMsg.Header.Set("StatusCode", "200")
-	responseMsg.Data = append(responseMsg.Data, tokenJson...)
-	fmt.Println(responseMsg.Header.Get("StatusCode"))
-	_, err = js.PublishMsgAsync(responseMsg)
-	log.Print(err)
-	if err != nil {
-		log.Printf("Failed to publish : %v", err)
+	created := event.New(request.RequestId, event.TypeSASTokenCreated, event.StatusCompleted).WithData(token)
+	createdMsg := created.Msg("artifact.createSASTokenResponse."+request.RequestId, http.StatusOK)
+	if err := pub.Respond(ctx, createdMsg); err != nil {
+		log.Printf("Failed to publish %s: %v", createdMsg.Subject, err)
 	}
 
 	return token.SASToken, nil
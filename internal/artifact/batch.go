@@ -0,0 +1,103 @@
+package artifact
+
+import (
+	"fmt"
+
+	"github.com/menderartifactsconsumer/internal/menderartifact"
+)
+
+const (
+	FailurePolicyContinue = "continue"
+	FailurePolicyStop     = "stop"
+)
+
+// UploadBatchRequest uploads several artifacts, possibly to several Mender
+// domains. Items without a request id get <batchId>-<index>. Concurrency and
+// FailurePolicy override the configured defaults when set.
+type UploadBatchRequest struct {
+	BatchId       string                  `json:"batchId"`
+	Items         []UploadArtifactRequest `json:"items"`
+	Concurrency   int                     `json:"concurrency,omitempty"`
+	FailurePolicy string                  `json:"failurePolicy,omitempty"`
+}
+
+// AssignRequestIds gives items without a request id <batchId>-<index>.
+func (b *UploadBatchRequest) AssignRequestIds() {
+	for i := range b.Items {
+		if b.Items[i].AuthRequest.RequestId == "" {
+			b.Items[i].AuthRequest.RequestId = fmt.Sprintf("%s-%d", b.BatchId, i)
+		}
+	}
+}
+
+type ItemStatus string
+
+const (
+	ItemCompleted ItemStatus = "completed"
+	ItemFailed    ItemStatus = "failed"
+	ItemCancelled ItemStatus = "cancelled"
+	ItemSkipped   ItemStatus = "skipped"
+	// ItemInProgress is an item whose request is being uploaded by another
+	// message, which reports its outcome.
+	ItemInProgress ItemStatus = "in_progress"
+)
+
+type BatchStatus string
+
+const (
+	BatchCompleted BatchStatus = "completed"
+	BatchPartial   BatchStatus = "partially_completed"
+	BatchFailed    BatchStatus = "failed"
+)
+
+// BatchItemResult is the outcome of one item of a batch. Artifact is the
+// metadata of completed items whose artifact was validated.
+type BatchItemResult struct {
+	RequestId        string                   `json:"requestId"`
+	Domain           string                   `json:"domain"`
+	ContainerName    string                   `json:"containerName"`
+	BlobName         string                   `json:"blobName"`
+	Status           ItemStatus               `json:"status"`
+	MenderStatusCode int                      `json:"menderStatusCode,omitempty"`
+	ErrorCode        string                   `json:"errorCode,omitempty"`
+	Message          string                   `json:"message,omitempty"`
+	Artifact         *menderartifact.Metadata `json:"artifact,omitempty"`
+}
+
+// UploadBatchResult is the data of batch.completed events.
+type UploadBatchResult struct {
+	BatchId    string            `json:"batchId"`
+	Status     BatchStatus       `json:"status"`
+	Succeeded  int               `json:"succeeded"`
+	Failed     int               `json:"failed"`
+	Skipped    int               `json:"skipped"`
+	InProgress int               `json:"inProgress"`
+	Items      []BatchItemResult `json:"items"`
+}
+
+// Aggregate counts the item results and sets the batch status: completed
+// when every item completed, failed when none completed or is still in
+// progress and partially_completed otherwise.
+func (r *UploadBatchResult) Aggregate() {
+	r.Succeeded, r.Failed, r.Skipped, r.InProgress = 0, 0, 0, 0
+	for _, item := range r.Items {
+		switch item.Status {
+		case ItemCompleted:
+			r.Succeeded++
+		case ItemSkipped:
+			r.Skipped++
+		case ItemInProgress:
+			r.InProgress++
+		default:
+			r.Failed++
+		}
+	}
+	switch {
+	case r.Succeeded == len(r.Items):
+		r.Status = BatchCompleted
+	case r.Succeeded == 0 && r.InProgress == 0:
+		r.Status = BatchFailed
+	default:
+		r.Status = BatchPartial
+	}
+}
@@ -0,0 +1,73 @@
+package artifact
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/menderartifactsconsumer/internal/event"
+	nats "github.com/nats-io/nats.go"
+)
+
+var ErrUploadCancelled = errors.New("upload cancelled")
+
+// statusClientClosedRequest is reported as the status code of cancelled
+// uploads, which never got a response from Mender.
+const statusClientClosedRequest = 499
+
+// track registers a cancellable context for the upload of requestId. The
+// returned function must be called once the upload is over.
+func (u *Uploader) track(ctx context.Context, requestId string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	u.mu.Lock()
+	u.running[requestId] = cancel
+	u.mu.Unlock()
+
+	return ctx, func() {
+		u.mu.Lock()
+		delete(u.running, requestId)
+		u.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// Cancel aborts the running upload of requestId. It reports whether such an
+// upload was running on this instance.
+func (u *Uploader) Cancel(requestId string) bool {
+	u.mu.Lock()
+	cancel, ok := u.running[requestId]
+	u.mu.Unlock()
+
+	if ok {
+		log.Printf("Cancelling upload %s", requestId)
+		cancel(ErrUploadCancelled)
+	}
+	return ok
+}
+
+// cancelledOr publishes the "Cancelled" status and returns ErrUploadCancelled
+// when ctx was cancelled through Cancel, and err otherwise.
+func (u *Uploader) cancelledOr(ctx context.Context, request *UploadArtifactRequest, err error) (*nats.Msg, error) {
+	if !errors.Is(context.Cause(ctx), ErrUploadCancelled) {
+		return nil, err
+	}
+	log.Printf("Upload %s was cancelled", request.AuthRequest.RequestId)
+	return u.publishCancelled(ctx, request), ErrUploadCancelled
+}
+
+// Cancelled reports an upload cancelled before it started: it publishes the
+// "Cancelled" status, records the job as cancelled and returns
+// ErrUploadCancelled.
+func (u *Uploader) Cancelled(ctx context.Context, request *UploadArtifactRequest) (*nats.Msg, error) {
+	log.Printf("Upload %s was cancelled before it started", request.AuthRequest.RequestId)
+	response := u.publishCancelled(ctx, request)
+	u.recordOutcome(ctx, request, 0, ErrUploadCancelled)
+	return response, ErrUploadCancelled
+}
+
+func (u *Uploader) publishCancelled(ctx context.Context, request *UploadArtifactRequest) *nats.Msg {
+	cancelled := event.New(request.AuthRequest.RequestId, event.TypeUploadCancelled, event.StatusCancelled).
+		WithMessage("upload cancelled on request")
+	return u.publishResult(ctx, request, cancelled, statusClientClosedRequest)
+}
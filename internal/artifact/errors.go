@@ -0,0 +1,127 @@
+package artifact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/menderartifactsconsumer/internal/failure"
+	"github.com/menderartifactsconsumer/internal/menderartifact"
+)
+
+// downloadError classifies a failed blob download. Missing blobs stay
+// transient since the blob may still be uploading when the request arrives.
+func downloadError(err error) error {
+	e := &failure.Error{Code: failure.CodeBlobDownloadFailed, Err: fmt.Errorf("download blob: %w", err)}
+	switch {
+	case bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.ContainerNotFound):
+		e.Code = failure.CodeBlobNotFound
+	case bloberror.HasCode(err, bloberror.AuthorizationFailure, bloberror.AuthorizationPermissionMismatch):
+		e.Code = failure.CodeBlobAccessDenied
+		e.Permanent = true
+	}
+
+	var responseErr *azcore.ResponseError
+	if errors.As(err, &responseErr) {
+		e.StatusCode = responseErr.StatusCode
+	}
+	return e
+}
+
+// SASTokenError classifies a failed SAS token creation like a failed blob
+// download: access denials and other 4xx responses are permanent, while
+// credential, network and 5xx errors are retried.
+func SASTokenError(err error) error {
+	e := &failure.Error{Code: failure.CodeSASTokenFailed, Err: fmt.Errorf("create SAS token: %w", err)}
+	var responseErr *azcore.ResponseError
+	if errors.As(err, &responseErr) {
+		e.StatusCode = responseErr.StatusCode
+		e.Permanent = responseErr.StatusCode >= http.StatusBadRequest && responseErr.StatusCode < http.StatusInternalServerError &&
+			responseErr.StatusCode != http.StatusRequestTimeout && responseErr.StatusCode != http.StatusTooManyRequests
+	}
+	if bloberror.HasCode(err, bloberror.AuthorizationFailure, bloberror.AuthorizationPermissionMismatch) {
+		e.Code = failure.CodeBlobAccessDenied
+		e.Permanent = true
+	}
+	return e
+}
+
+// checksumReader computes the SHA-256 checksum of an artifact while it is
+// read and compares it with the expected one once the artifact was read
+// completely, before its end is returned.
+type checksumReader struct {
+	r        io.Reader
+	h        hash.Hash
+	expected string
+}
+
+func newChecksumReader(r io.Reader, expected string) *checksumReader {
+	return &checksumReader{r: r, h: sha256.New(), expected: strings.ToLower(expected)}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.h.Write(p[:n])
+	if err == io.EOF {
+		if actual := hex.EncodeToString(c.h.Sum(nil)); actual != c.expected {
+			return n, &menderartifact.ChecksumError{Name: "artifact", Expected: c.expected, Actual: actual}
+		}
+	}
+	return n, err
+}
+
+// validChecksum reports whether checksum is a hex encoded SHA-256 checksum.
+func validChecksum(checksum string) bool {
+	decoded, err := hex.DecodeString(checksum)
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// errResponseReceived stops streaming an artifact once Mender answered.
+var errResponseReceived = errors.New("mender response received")
+
+// artifactError classifies the error of streaming an artifact when the
+// artifact itself was invalid, badly signed, corrupted or could not be
+// signed and returns nil otherwise.
+func artifactError(err error) error {
+	var formatErr *menderartifact.FormatError
+	if errors.As(err, &formatErr) {
+		return failure.Permanent(failure.CodeInvalidArtifact, err)
+	}
+	var signatureErr *menderartifact.SignatureError
+	if errors.As(err, &signatureErr) {
+		return failure.Permanent(failure.CodeInvalidSignature, err)
+	}
+	var signingErr *menderartifact.SigningError
+	if errors.As(err, &signingErr) {
+		return failure.Transient(failure.CodeSigningFailed, err)
+	}
+	var checksumErr *menderartifact.ChecksumError
+	if errors.As(err, &checksumErr) {
+		// Blobs are downloaded over TLS, so neither a mismatch with the
+		// checksum of the request nor one with the manifest comes from the
+		// transfer: the next download would read the same bytes.
+		return failure.Permanent(failure.CodeIntegrityError, err)
+	}
+	return nil
+}
+
+// menderError classifies a non-2xx Mender response, including the error
+// message of its body when there is one.
+func menderError(statusCode int, body []byte) error {
+	var response struct {
+		Error string `json:"error"`
+	}
+	err := fmt.Errorf("mender responded with status %d", statusCode)
+	if json.Unmarshal(body, &response) == nil && strings.TrimSpace(response.Error) != "" {
+		err = fmt.Errorf("%w: %s", err, strings.TrimSpace(response.Error))
+	}
+	return failure.FromHTTPStatus(statusCode, err)
+}
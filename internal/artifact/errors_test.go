@@ -0,0 +1,74 @@
+package artifact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/menderartifactsconsumer/internal/failure"
+	"github.com/menderartifactsconsumer/internal/menderartifact"
+)
+
+func TestArtifactError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		code      failure.Code
+		permanent bool
+	}{
+		{name: "format", err: &menderartifact.FormatError{}, code: failure.CodeInvalidArtifact, permanent: true},
+		{name: "signature", err: &menderartifact.SignatureError{}, code: failure.CodeInvalidSignature, permanent: true},
+		{name: "signing", err: &menderartifact.SigningError{}, code: failure.CodeSigningFailed},
+		{name: "request checksum", err: &menderartifact.ChecksumError{Name: "artifact"}, code: failure.CodeIntegrityError, permanent: true},
+		{name: "manifest checksum", err: &menderartifact.ChecksumError{Name: "data/0000/rootfs.ext4"}, code: failure.CodeIntegrityError, permanent: true},
+		{name: "other", err: errors.New("connection reset")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := artifactError(tt.err)
+			if tt.code == "" {
+				if err != nil {
+					t.Fatalf("artifactError() = %v, want nil", err)
+				}
+				return
+			}
+			if code := failure.CodeOf(err); code != tt.code {
+				t.Errorf("code = %s, want %s", code, tt.code)
+			}
+			if permanent := failure.IsPermanent(err); permanent != tt.permanent {
+				t.Errorf("permanent = %t, want %t", permanent, tt.permanent)
+			}
+		})
+	}
+}
+
+func TestChecksumReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+		want     bool
+	}{
+		{name: "match", expected: sha256Hex("artifact")},
+		{name: "upper case", expected: strings.ToUpper(sha256Hex("artifact"))},
+		{name: "mismatch", expected: sha256Hex("other"), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := io.ReadAll(newChecksumReader(strings.NewReader("artifact"), tt.expected))
+			var checksumErr *menderartifact.ChecksumError
+			if errors.As(err, &checksumErr) != tt.want {
+				t.Errorf("read error = %v, want mismatch %t", err, tt.want)
+			}
+		})
+	}
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
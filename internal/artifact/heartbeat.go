@@ -0,0 +1,43 @@
+package artifact
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// KeepAlive calls msg.InProgress every interval so that JetStream does not
+// redeliver msg while it is being processed. It stops when ctx is done or the
+// returned function is called.
+func KeepAlive(ctx context.Context, msg jetstream.Msg, interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := msg.InProgress(); err != nil {
+					log.Printf("Failed to send in-progress heartbeat for %s: %v", msg.Subject(), err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
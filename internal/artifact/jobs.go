@@ -0,0 +1,48 @@
+package artifact
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/menderartifactsconsumer/internal/failure"
+	"github.com/menderartifactsconsumer/internal/jobs"
+)
+
+// transition records a job state change. Failing to persist it is logged but
+// does not fail the upload.
+func (u *Uploader) transition(ctx context.Context, request *UploadArtifactRequest, state jobs.State, update func(*jobs.Job)) {
+	err := u.jobs.Transition(context.WithoutCancel(ctx), request.AuthRequest.RequestId, state, func(job *jobs.Job) {
+		job.Domain = request.AuthRequest.Domain
+		job.ContainerName = request.BlobMetadata.ContainerName
+		job.BlobName = request.BlobMetadata.BlobName
+		if update != nil {
+			update(job)
+		}
+	})
+	if err != nil {
+		log.Printf("Failed to record %s state of job %s: %v", state, request.AuthRequest.RequestId, err)
+	}
+}
+
+// recordOutcome stores the final state of an upload attempt.
+func (u *Uploader) recordOutcome(ctx context.Context, request *UploadArtifactRequest, menderStatusCode int, err error) {
+	switch {
+	case err == nil:
+		u.transition(ctx, request, jobs.StateCompleted, func(job *jobs.Job) {
+			job.MenderStatusCode = menderStatusCode
+			job.Error = ""
+		})
+	case errors.Is(err, ErrUploadCancelled):
+		u.transition(ctx, request, jobs.StateCancelled, func(job *jobs.Job) {
+			job.Error = failure.Message(err)
+		})
+	default:
+		u.transition(ctx, request, jobs.StateFailed, func(job *jobs.Job) {
+			if statusCode := failure.StatusCode(err); statusCode != 0 {
+				job.MenderStatusCode = statusCode
+			}
+			job.Error = failure.Message(err)
+		})
+	}
+}
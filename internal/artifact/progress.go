@@ -0,0 +1,101 @@
+package artifact
+
+import (
+	"io"
+	"time"
+
+	"github.com/menderartifactsconsumer/internal/event"
+	"github.com/menderartifactsconsumer/internal/publisher"
+)
+
+// UploadArtifactProgress is the data of upload.progress events.
+type UploadArtifactProgress struct {
+	BytesTransferred int64   `json:"bytesTransferred"`
+	TotalBytes       int64   `json:"totalBytes"`
+	Percent          float64 `json:"percent"`
+	BytesPerSecond   float64 `json:"bytesPerSecond"`
+	ETASeconds       float64 `json:"etaSeconds"`
+}
+
+// progressReader counts the bytes read through it and reports progress at
+// most once per interval, and only once the transfer advanced by percentStep
+// when the total size is known. The final report is always sent.
+type progressReader struct {
+	reader      io.Reader
+	requestId   string
+	total       int64
+	interval    time.Duration
+	percentStep float64
+	report      func(requestId string, progress UploadArtifactProgress)
+
+	read        int64
+	start       time.Time
+	lastReport  time.Time
+	lastPercent float64
+	finished    bool
+}
+
+func newProgressReader(reader io.Reader, requestId string, total int64, interval time.Duration, percentStep float64, report func(requestId string, progress UploadArtifactProgress)) *progressReader {
+	now := time.Now()
+	return &progressReader{
+		reader:      reader,
+		requestId:   requestId,
+		total:       total,
+		interval:    interval,
+		percentStep: percentStep,
+		report:      report,
+		start:       now,
+		lastReport:  now,
+	}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	p.read += int64(n)
+
+	progress := p.progress()
+	switch {
+	case err == io.EOF && !p.finished:
+		p.finished = true
+		p.send(progress)
+	case err == nil && time.Since(p.lastReport) >= p.interval &&
+		(p.total <= 0 || progress.Percent-p.lastPercent >= p.percentStep):
+		p.send(progress)
+	}
+	return n, err
+}
+
+func (p *progressReader) send(progress UploadArtifactProgress) {
+	p.lastReport = time.Now()
+	p.lastPercent = progress.Percent
+	p.report(p.requestId, progress)
+}
+
+func (p *progressReader) progress() UploadArtifactProgress {
+	progress := UploadArtifactProgress{
+		BytesTransferred: p.read,
+		TotalBytes:       p.total,
+	}
+
+	elapsed := time.Since(p.start).Seconds()
+	if elapsed > 0 {
+		progress.BytesPerSecond = float64(p.read) / elapsed
+	}
+	if p.total > 0 {
+		progress.Percent = float64(p.read) * 100 / float64(p.total)
+		if progress.BytesPerSecond > 0 && p.read < p.total {
+			progress.ETASeconds = float64(p.total-p.read) / progress.BytesPerSecond
+		}
+	}
+	return progress
+}
+
+// publishProgress reports progress without blocking the upload stream.
+// Progress that cannot be published is dropped rather than spooled, since a
+// later report supersedes it.
+func publishProgress(pub *publisher.Publisher) func(string, UploadArtifactProgress) {
+	return func(requestId string, progress UploadArtifactProgress) {
+		e := event.New(requestId, event.TypeUploadProgress, event.StatusInProgress).WithData(progress)
+		pub.Notify(e.Msg("artifact.uploadArtifactProgress."+requestId, 0))
+	}
+}
@@ -0,0 +1,54 @@
+package artifact
+
+import (
+	"github.com/menderartifactsconsumer/internal/config"
+	"github.com/menderartifactsconsumer/internal/menderartifact"
+)
+
+// keyring holds the public keys artifact signatures are verified with.
+type keyring struct {
+	policy  string
+	keys    []menderartifact.PublicKey
+	domains map[string][]menderartifact.PublicKey
+}
+
+func loadKeyring(cfg config.SignatureConfig) (*keyring, error) {
+	k := &keyring{policy: cfg.Policy, domains: make(map[string][]menderartifact.PublicKey)}
+	if cfg.Policy == "ignore" {
+		return k, nil
+	}
+
+	for _, path := range cfg.PublicKeys {
+		keys, err := menderartifact.LoadPublicKeys(path)
+		if err != nil {
+			return nil, err
+		}
+		k.keys = append(k.keys, keys...)
+	}
+	for domain, path := range cfg.DomainKeys {
+		keys, err := menderartifact.LoadPublicKeys(path)
+		if err != nil {
+			return nil, err
+		}
+		k.domains[domain] = keys
+	}
+	return k, nil
+}
+
+// options returns how artifacts uploaded to domain are verified. Without
+// global keys, the artifacts of domains that have no keys of their own are
+// not verified, since no signature could pass.
+func (k *keyring) options(domain string) menderartifact.Options {
+	keys, ok := k.domains[domain]
+	if !ok {
+		keys = k.keys
+	}
+	if len(keys) == 0 {
+		return menderartifact.Options{}
+	}
+	return menderartifact.Options{
+		VerifySignature:  k.policy != "ignore",
+		RequireSignature: k.policy == "require",
+		PublicKeys:       keys,
+	}
+}
@@ -0,0 +1,67 @@
+package artifact
+
+import (
+	"testing"
+
+	"github.com/menderartifactsconsumer/internal/menderartifact"
+)
+
+func TestKeyringOptions(t *testing.T) {
+	global := []menderartifact.PublicKey{{Fingerprint: "global"}}
+	tenant := []menderartifact.PublicKey{{Fingerprint: "tenant"}}
+	domainOnly := map[string][]menderartifact.PublicKey{"tenant.example.com": tenant}
+
+	tests := []struct {
+		name    string
+		keyring keyring
+		domain  string
+		want    menderartifact.Options
+	}{
+		{
+			name:    "ignore",
+			keyring: keyring{policy: "ignore"},
+			domain:  "tenant.example.com",
+		},
+		{
+			name:    "global keys",
+			keyring: keyring{policy: "verify", keys: global},
+			domain:  "other.example.com",
+			want:    menderartifact.Options{VerifySignature: true, PublicKeys: global},
+		},
+		{
+			name:    "domain keys replace global keys",
+			keyring: keyring{policy: "require", keys: global, domains: domainOnly},
+			domain:  "tenant.example.com",
+			want:    menderartifact.Options{VerifySignature: true, RequireSignature: true, PublicKeys: tenant},
+		},
+		{
+			name:    "domain only with keys",
+			keyring: keyring{policy: "verify", domains: domainOnly},
+			domain:  "tenant.example.com",
+			want:    menderartifact.Options{VerifySignature: true, PublicKeys: tenant},
+		},
+		{
+			name:    "domain only verify without keys",
+			keyring: keyring{policy: "verify", domains: domainOnly},
+			domain:  "other.example.com",
+		},
+		{
+			name:    "domain only require without keys",
+			keyring: keyring{policy: "require", domains: domainOnly},
+			domain:  "other.example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.keyring.options(tt.domain)
+			if got.VerifySignature != tt.want.VerifySignature || got.RequireSignature != tt.want.RequireSignature {
+				t.Errorf("options(%q) verify = %t, require = %t, want %t, %t", tt.domain,
+					got.VerifySignature, got.RequireSignature, tt.want.VerifySignature, tt.want.RequireSignature)
+			}
+			if len(got.PublicKeys) != len(tt.want.PublicKeys) || (len(got.PublicKeys) > 0 && got.PublicKeys[0].Fingerprint != tt.want.PublicKeys[0].Fingerprint) {
+				t.Errorf("options(%q) keys = %v, want %v", tt.domain, got.PublicKeys, tt.want.PublicKeys)
+			}
+		})
+	}
+}
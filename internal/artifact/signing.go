@@ -0,0 +1,72 @@
+package artifact
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/menderartifactsconsumer/internal/config"
+	"github.com/menderartifactsconsumer/internal/menderartifact"
+)
+
+// KeyProvider supplies the private key artifacts uploaded to a Mender domain
+// are signed with, e.g. a key held in a KMS or an HSM behind crypto.Signer.
+// Only RSA and ECDSA keys are supported.
+type KeyProvider interface {
+	SigningKey(ctx context.Context, domain string) (crypto.Signer, error)
+}
+
+// KeyProviderFactory creates the key provider named by
+// artifact.signing.provider from the signing configuration.
+type KeyProviderFactory func(cfg config.SigningConfig) (KeyProvider, error)
+
+var (
+	keyProvidersMu sync.Mutex
+	keyProviders   = map[string]KeyProviderFactory{
+		"file": func(cfg config.SigningConfig) (KeyProvider, error) {
+			if cfg.KeyFile == "" {
+				return nil, errors.New("the file key provider requires ARTIFACT_SIGNING_KEY_FILE")
+			}
+			return NewFileKeyProvider(cfg.KeyFile)
+		},
+	}
+)
+
+// RegisterKeyProvider makes a key provider available to
+// artifact.signing.provider under name. It must be called before the
+// uploader is created, typically from an init function.
+func RegisterKeyProvider(name string, factory KeyProviderFactory) {
+	keyProvidersMu.Lock()
+	defer keyProvidersMu.Unlock()
+	keyProviders[name] = factory
+}
+
+func newKeyProvider(cfg config.SigningConfig) (KeyProvider, error) {
+	keyProvidersMu.Lock()
+	factory, ok := keyProviders[cfg.Provider]
+	keyProvidersMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown key provider %q", cfg.Provider)
+	}
+	return factory(cfg)
+}
+
+// FileKeyProvider signs the artifacts of every domain with one key loaded
+// from a PEM file.
+type FileKeyProvider struct {
+	signer crypto.Signer
+}
+
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	signer, err := menderartifact.LoadPrivateKey(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileKeyProvider{signer: signer}, nil
+}
+
+func (p *FileKeyProvider) SigningKey(ctx context.Context, domain string) (crypto.Signer, error) {
+	return p.signer, nil
+}
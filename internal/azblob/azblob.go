@@ -80,6 +80,7 @@ func GenerateSASStoken(cfg *config.Config, containerName string, blobName string
 	udc, err := client.GetUserDelegationCredential(context.Background(), info, nil)
 	if err != nil {
 		log.Printf("Failed to get user delegation credential: %s", err)
+		return "", err
 	}
 	sasQueryParams, err := sas.BlobSignatureValues{
 		Protocol:      sas.ProtocolHTTPS,
@@ -1,24 +1,568 @@
 package config
 
 import (
-	"log"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
+const ConfigFileEnv = "CONFIG_FILE"
+
+// serviceName is the name format accepted by the NATS micro package.
+var serviceName = regexp.MustCompile(`^[A-Za-z0-9\-_]+$`)
+
 type Config struct {
-	NATSURL         string `JSON:"NATS_URL"`
-	NATSCredentials string `JSON:"NATS_CREDENTIALS"`
-	BlobStorageUrl  string `JSON:"BLOB_STORAGE_URL"`
+	NATSURL          string    `yaml:"nats_url"`
+	NATSCredentials  string    `yaml:"nats_credentials"`
+	NATSNKeySeedFile string    `yaml:"nats_nkey_seed_file"`
+	NATSToken        string    `yaml:"nats_token"`
+	NATSUser         string    `yaml:"nats_user"`
+	NATSPassword     string    `yaml:"nats_password"`
+	NATSTLS          TLSConfig `yaml:"nats_tls"`
+	BlobStorageUrl   string    `yaml:"blob_storage_url"`
+
+	UnhandledSubjectPrefix string        `yaml:"unhandled_subject_prefix"`
+	HandlerTimeout         time.Duration `yaml:"handler_timeout"`
+	AuthHeader             string        `yaml:"auth_header"`
+	AuthTokens             []string      `yaml:"auth_tokens"`
+	ShutdownGracePeriod    time.Duration `yaml:"shutdown_grace_period"`
+	DrainTimeout           time.Duration `yaml:"drain_timeout"`
+
+	MetricsAddr             string          `yaml:"metrics_addr"`
+	RetryBackoff            []time.Duration `yaml:"retry_backoff"`
+	DeadLetterSubjectPrefix string          `yaml:"dead_letter_subject_prefix"`
+
+	Stream      StreamConfig      `yaml:"stream"`
+	Consumer    ConsumerConfig    `yaml:"consumer"`
+	Workers     WorkersConfig     `yaml:"workers"`
+	Idempotency IdempotencyConfig `yaml:"idempotency"`
+	Progress    ProgressConfig    `yaml:"progress"`
+	Jobs        JobsConfig        `yaml:"jobs"`
+	Publisher   PublisherConfig   `yaml:"publisher"`
+	Service     ServiceConfig     `yaml:"service"`
+	Batch       BatchConfig       `yaml:"batch"`
+	Artifact    ArtifactConfig    `yaml:"artifact"`
+}
+
+type StreamConfig struct {
+	Name      string        `yaml:"name"`
+	Subjects  []string      `yaml:"subjects"`
+	Retention string        `yaml:"retention"`
+	Storage   string        `yaml:"storage"`
+	Replicas  int           `yaml:"replicas"`
+	MaxAge    time.Duration `yaml:"max_age"`
+}
+
+type ConsumerConfig struct {
+	Name           string          `yaml:"name"`
+	FilterSubjects []string        `yaml:"filter_subjects"`
+	AckWait        time.Duration   `yaml:"ack_wait"`
+	MaxDeliver     int             `yaml:"max_deliver"`
+	MaxAckPending  int             `yaml:"max_ack_pending"`
+	BackOff        []time.Duration `yaml:"backoff"`
+}
+
+// HeartbeatInterval is how often in-progress acks are sent for long running
+// messages, a third of the shortest ack timeout so a single lost heartbeat
+// does not cause a redelivery. With BackOff set the server uses its delays
+// instead of AckWait as the ack timeout of each delivery.
+func (c ConsumerConfig) HeartbeatInterval() time.Duration {
+	timeout := c.AckWait
+	for _, delay := range c.BackOff {
+		timeout = min(timeout, delay)
+	}
+	return timeout / 3
+}
+
+type WorkersConfig struct {
+	Count     int `yaml:"count"`
+	PerDomain int `yaml:"per_domain"`
+}
+
+// ArtifactConfig controls the checks applied to artifacts while they stream
+// from blob storage to Mender.
+type ArtifactConfig struct {
+	Validate  bool            `yaml:"validate"`
+	Signature SignatureConfig `yaml:"signature"`
+	Signing   SigningConfig   `yaml:"signing"`
+}
+
+// SigningConfig lists the Mender domains whose artifacts are signed, and the
+// key provider supplying their key. The file provider loads the PEM file
+// KeyFile; other providers are registered by the artifact package.
+type SigningConfig struct {
+	Domains  []string `yaml:"domains"`
+	Provider string   `yaml:"provider"`
+	KeyFile  string   `yaml:"key_file"`
+}
+
+// SignatureConfig sets whether artifact signatures are ignored, verified when
+// present or required, and the PEM files of the public keys they are verified
+// with. DomainKeys maps Mender domains to the files of their own keys, which
+// replace PublicKeys for those domains.
+type SignatureConfig struct {
+	Policy     string            `yaml:"policy"`
+	PublicKeys []string          `yaml:"public_keys"`
+	DomainKeys map[string]string `yaml:"domain_keys"`
+}
+
+// BatchConfig sets how many items of a batch upload run at once and whether
+// the remaining items still start after one failed.
+type BatchConfig struct {
+	Concurrency   int    `yaml:"concurrency"`
+	FailurePolicy string `yaml:"failure_policy"`
+	MaxItems      int    `yaml:"max_items"`
+}
+
+type JobsConfig struct {
+	Bucket string        `yaml:"bucket"`
+	TTL    time.Duration `yaml:"ttl"`
+}
+
+// ServiceConfig names the micro service serving synchronous requests and the
+// queue group its instances share them through.
+type ServiceConfig struct {
+	Name       string `yaml:"name"`
+	QueueGroup string `yaml:"queue_group"`
+}
+
+type ProgressConfig struct {
+	Interval    time.Duration `yaml:"interval"`
+	PercentStep float64       `yaml:"percent_step"`
+}
+
+// PublisherConfig controls how responses are published. A publish is retried
+// after each RetryBackoff delay before it is spooled to OutboxDir.
+type PublisherConfig struct {
+	AckTimeout    time.Duration   `yaml:"ack_timeout"`
+	RetryBackoff  []time.Duration `yaml:"retry_backoff"`
+	OutboxDir     string          `yaml:"outbox_dir"`
+	FlushInterval time.Duration   `yaml:"flush_interval"`
+}
+
+type IdempotencyConfig struct {
+	Bucket            string        `yaml:"bucket"`
+	TTL               time.Duration `yaml:"ttl"`
+	ProcessingTimeout time.Duration `yaml:"processing_timeout"`
+}
+
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	CAFile   string `yaml:"ca_file"`
 }
 
+func Default() Config {
+	return Config{
+		NATSURL:                 "nats://127.0.0.1:4222",
+		UnhandledSubjectPrefix:  "artifact.unhandledResponse",
+		HandlerTimeout:          10 * time.Minute,
+		AuthHeader:              "Auth-Token",
+		ShutdownGracePeriod:     2 * time.Minute,
+		DrainTimeout:            30 * time.Second,
+		RetryBackoff:            []time.Duration{5 * time.Second, 30 * time.Second, 2 * time.Minute, 5 * time.Minute},
+		DeadLetterSubjectPrefix: "artifact.dlq",
+		MetricsAddr:             ":9090",
+		Stream: StreamConfig{
+			Name: "MenderUser",
+			Subjects: []string{
+				"artifact.uploadArtifact.>",
+				"artifact.GenerateSASToken.>",
+				"artifact.uploadArtifactResponse.>",
+				"artifact.uploadArtifactTargetApplicationResponse.>",
+				"artifact.uploadArtifactProgress.>",
+				"artifact.uploadBatch.>",
+				"artifact.uploadBatchResponse.>",
+				"artifact.createSASTokenResponse.>",
+				"artifact.unhandledResponse.>",
+				"artifact.dlq.>",
+			},
+			Retention: "limits",
+			Storage:   "file",
+			Replicas:  1,
+			MaxAge:    7 * 24 * time.Hour,
+		},
+		Consumer: ConsumerConfig{
+			Name:       "mender_artifact",
+			AckWait:    30 * time.Second,
+			MaxDeliver: 5,
+		},
+		Workers: WorkersConfig{
+			Count:     4,
+			PerDomain: 2,
+		},
+		Idempotency: IdempotencyConfig{
+			Bucket:            "artifact_requests",
+			TTL:               7 * 24 * time.Hour,
+			ProcessingTimeout: 15 * time.Minute,
+		},
+		Progress: ProgressConfig{
+			Interval:    2 * time.Second,
+			PercentStep: 1,
+		},
+		Jobs: JobsConfig{
+			Bucket: "artifact_jobs",
+			TTL:    30 * 24 * time.Hour,
+		},
+		Publisher: PublisherConfig{
+			AckTimeout:    5 * time.Second,
+			RetryBackoff:  []time.Duration{250 * time.Millisecond, time.Second, 4 * time.Second},
+			OutboxDir:     "outbox",
+			FlushInterval: 30 * time.Second,
+		},
+		Service: ServiceConfig{
+			Name:       "menderartifactsconsumer",
+			QueueGroup: "mender_artifacts",
+		},
+		Batch: BatchConfig{
+			Concurrency:   2,
+			FailurePolicy: "continue",
+			MaxItems:      100,
+		},
+		Artifact: ArtifactConfig{
+			Validate: true,
+			Signature: SignatureConfig{
+				Policy: "ignore",
+			},
+			Signing: SigningConfig{
+				Provider: "file",
+			},
+		},
+	}
+}
+
+// Load builds the configuration from the defaults, the optional file named by
+// CONFIG_FILE and finally the environment, each layer overriding the previous.
 func Load() (*Config, error) {
-	var cfg Config
-	cfg.NATSURL = "nats://20.52.109.144:4222"
-	// cfg.NATSCredentials = "NGS-Karthick-karthick.creds"
-	cfg.BlobStorageUrl = "https://mendertemporarystorage.blob.core.windows.net/"
+	cfg := Default()
 
-	if cfg.NATSURL == "" {
-		log.Fatal("Critical configuration is missing")
+	if path := os.Getenv(ConfigFileEnv); path != "" {
+		if err := loadFile(path, &cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := loadEnv(&cfg, os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
 
 	return &cfg, nil
 }
+
+func loadFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml", ".json":
+		// JSON is a subset of YAML, so one decoder covers both formats.
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("parse config file %s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("unsupported config file extension %q", ext)
+	}
+
+	return nil
+}
+
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.NATSURL == "" {
+		errs = append(errs, errors.New("NATS_URL is required"))
+	} else {
+		for _, server := range strings.Split(c.NATSURL, ",") {
+			if err := validateURL(strings.TrimSpace(server), "nats", "tls", "ws", "wss"); err != nil {
+				errs = append(errs, fmt.Errorf("NATS_URL: %w", err))
+			}
+		}
+	}
+
+	if c.BlobStorageUrl == "" {
+		errs = append(errs, errors.New("BLOB_STORAGE_URL is required"))
+	} else if err := validateURL(c.BlobStorageUrl, "https", "http"); err != nil {
+		errs = append(errs, fmt.Errorf("BLOB_STORAGE_URL: %w", err))
+	}
+
+	errs = append(errs, c.validateNATSAuth()...)
+
+	if !isLiteralSubject(c.UnhandledSubjectPrefix) {
+		errs = append(errs, fmt.Errorf("UNHANDLED_SUBJECT_PREFIX %q must be a literal subject", c.UnhandledSubjectPrefix))
+	}
+	if !isLiteralSubject(c.DeadLetterSubjectPrefix) {
+		errs = append(errs, fmt.Errorf("DEAD_LETTER_SUBJECT_PREFIX %q must be a literal subject", c.DeadLetterSubjectPrefix))
+	}
+	errs = append(errs, c.validateStream()...)
+
+	if c.HandlerTimeout <= 0 {
+		errs = append(errs, errors.New("HANDLER_TIMEOUT must be positive"))
+	}
+	if c.ShutdownGracePeriod <= 0 {
+		errs = append(errs, errors.New("SHUTDOWN_GRACE_PERIOD must be positive"))
+	}
+	if c.DrainTimeout <= 0 {
+		errs = append(errs, errors.New("DRAIN_TIMEOUT must be positive"))
+	}
+	for _, delay := range c.RetryBackoff {
+		if delay < 0 {
+			errs = append(errs, errors.New("RETRY_BACKOFF delays must not be negative"))
+			break
+		}
+	}
+	if c.Workers.Count < 1 {
+		errs = append(errs, errors.New("WORKERS_COUNT must be positive"))
+	}
+	if c.Workers.PerDomain < 0 {
+		errs = append(errs, errors.New("WORKERS_PER_DOMAIN must not be negative"))
+	}
+	if c.Idempotency.Bucket == "" {
+		errs = append(errs, errors.New("IDEMPOTENCY_BUCKET is required"))
+	}
+	if c.Idempotency.TTL < 0 {
+		errs = append(errs, errors.New("IDEMPOTENCY_TTL must not be negative"))
+	}
+	if c.Idempotency.ProcessingTimeout < c.HandlerTimeout {
+		errs = append(errs, errors.New("IDEMPOTENCY_PROCESSING_TIMEOUT must not be shorter than HANDLER_TIMEOUT"))
+	}
+	if c.Jobs.Bucket == "" {
+		errs = append(errs, errors.New("JOBS_BUCKET is required"))
+	}
+	if c.Jobs.TTL < 0 {
+		errs = append(errs, errors.New("JOBS_TTL must not be negative"))
+	}
+	if !serviceName.MatchString(c.Service.Name) {
+		errs = append(errs, fmt.Errorf("SERVICE_NAME %q may only contain letters, digits, '-' and '_'", c.Service.Name))
+	}
+	if c.Service.QueueGroup == "" || strings.ContainsAny(c.Service.QueueGroup, "*> \t") {
+		errs = append(errs, fmt.Errorf("SERVICE_QUEUE_GROUP %q is invalid", c.Service.QueueGroup))
+	}
+	if c.Progress.Interval < 0 {
+		errs = append(errs, errors.New("PROGRESS_INTERVAL must not be negative"))
+	}
+	if c.Progress.PercentStep < 0 || c.Progress.PercentStep > 100 {
+		errs = append(errs, errors.New("PROGRESS_PERCENT_STEP must be between 0 and 100"))
+	}
+	if c.Batch.Concurrency < 1 {
+		errs = append(errs, errors.New("BATCH_CONCURRENCY must be positive"))
+	}
+	switch c.Batch.FailurePolicy {
+	case "continue", "stop":
+	default:
+		errs = append(errs, fmt.Errorf("BATCH_FAILURE_POLICY %q must be continue or stop", c.Batch.FailurePolicy))
+	}
+	if c.Batch.MaxItems < 1 {
+		errs = append(errs, errors.New("BATCH_MAX_ITEMS must be positive"))
+	}
+	if c.Publisher.AckTimeout <= 0 {
+		errs = append(errs, errors.New("PUBLISHER_ACK_TIMEOUT must be positive"))
+	}
+	for _, delay := range c.Publisher.RetryBackoff {
+		if delay < 0 {
+			errs = append(errs, errors.New("PUBLISHER_RETRY_BACKOFF delays must not be negative"))
+			break
+		}
+	}
+	if c.Publisher.OutboxDir == "" {
+		errs = append(errs, errors.New("PUBLISHER_OUTBOX_DIR is required"))
+	}
+	if c.Publisher.FlushInterval <= 0 {
+		errs = append(errs, errors.New("PUBLISHER_FLUSH_INTERVAL must be positive"))
+	}
+	if len(c.AuthTokens) > 0 && c.AuthHeader == "" {
+		errs = append(errs, errors.New("AUTH_HEADER is required when AUTH_TOKENS is set"))
+	}
+	errs = append(errs, c.validateSignature()...)
+	if signing := c.Artifact.Signing; len(signing.Domains) > 0 {
+		if signing.Provider == "" {
+			errs = append(errs, errors.New("ARTIFACT_SIGNING_PROVIDER is required when ARTIFACT_SIGNING_DOMAINS is set"))
+		}
+		if signing.Provider == "file" && signing.KeyFile == "" {
+			errs = append(errs, errors.New("ARTIFACT_SIGNING_KEY_FILE is required by the file provider"))
+		}
+	}
+	if c.Artifact.Signing.KeyFile != "" {
+		if err := fileExists(c.Artifact.Signing.KeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("ARTIFACT_SIGNING_KEY_FILE: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Config) validateSignature() []error {
+	var errs []error
+
+	signature := c.Artifact.Signature
+	switch signature.Policy {
+	case "ignore":
+		return nil
+	case "verify", "require":
+	default:
+		return []error{fmt.Errorf("ARTIFACT_SIGNATURE_POLICY %q must be ignore, verify or require", signature.Policy)}
+	}
+	if !c.Artifact.Validate {
+		errs = append(errs, errors.New("ARTIFACT_VALIDATE must be set when ARTIFACT_SIGNATURE_POLICY is not ignore"))
+	}
+	if len(signature.PublicKeys) == 0 && len(signature.DomainKeys) == 0 {
+		errs = append(errs, errors.New("ARTIFACT_SIGNATURE_PUBLIC_KEYS or ARTIFACT_SIGNATURE_DOMAIN_KEYS is required when ARTIFACT_SIGNATURE_POLICY is not ignore"))
+	}
+	for _, path := range signature.PublicKeys {
+		if err := fileExists(path); err != nil {
+			errs = append(errs, fmt.Errorf("ARTIFACT_SIGNATURE_PUBLIC_KEYS: %w", err))
+		}
+	}
+	for domain, path := range signature.DomainKeys {
+		if err := fileExists(path); err != nil {
+			errs = append(errs, fmt.Errorf("ARTIFACT_SIGNATURE_DOMAIN_KEYS %s: %w", domain, err))
+		}
+	}
+
+	return errs
+}
+
+func (c *Config) validateStream() []error {
+	var errs []error
+
+	if c.Stream.Name == "" || strings.ContainsAny(c.Stream.Name, ".*> \t") {
+		errs = append(errs, fmt.Errorf("STREAM_NAME %q is invalid", c.Stream.Name))
+	}
+	if len(c.Stream.Subjects) == 0 {
+		errs = append(errs, errors.New("STREAM_SUBJECTS is required"))
+	}
+	switch c.Stream.Retention {
+	case "limits", "interest", "workqueue":
+	default:
+		errs = append(errs, fmt.Errorf("STREAM_RETENTION %q must be limits, interest or workqueue", c.Stream.Retention))
+	}
+	switch c.Stream.Storage {
+	case "file", "memory":
+	default:
+		errs = append(errs, fmt.Errorf("STREAM_STORAGE %q must be file or memory", c.Stream.Storage))
+	}
+	if c.Stream.Replicas < 1 || c.Stream.Replicas > 5 {
+		errs = append(errs, errors.New("STREAM_REPLICAS must be between 1 and 5"))
+	}
+	if c.Stream.MaxAge < 0 {
+		errs = append(errs, errors.New("STREAM_MAX_AGE must not be negative"))
+	}
+
+	if c.Consumer.Name == "" || strings.ContainsAny(c.Consumer.Name, ".*> \t") {
+		errs = append(errs, fmt.Errorf("CONSUMER_NAME %q is invalid", c.Consumer.Name))
+	}
+	if c.Consumer.AckWait < 3*time.Second {
+		errs = append(errs, errors.New("CONSUMER_ACK_WAIT must be at least 3s"))
+	}
+	if c.Consumer.MaxDeliver == 0 || c.Consumer.MaxDeliver < -1 {
+		errs = append(errs, errors.New("CONSUMER_MAX_DELIVER must be positive or -1 for unlimited"))
+	}
+	if c.Consumer.MaxAckPending < -1 {
+		errs = append(errs, errors.New("CONSUMER_MAX_ACK_PENDING must be positive, 0 for four per worker or -1 for unlimited"))
+	}
+	if len(c.Consumer.BackOff) > 0 && c.Consumer.MaxDeliver != -1 && c.Consumer.MaxDeliver <= len(c.Consumer.BackOff) {
+		errs = append(errs, errors.New("CONSUMER_MAX_DELIVER must be greater than the number of CONSUMER_BACKOFF delays"))
+	}
+	for _, delay := range c.Consumer.BackOff {
+		if delay < 3*time.Second {
+			errs = append(errs, errors.New("CONSUMER_BACKOFF delays must be at least 3s"))
+			break
+		}
+	}
+
+	return errs
+}
+
+func (c *Config) validateNATSAuth() []error {
+	var errs []error
+
+	var methods []string
+	if c.NATSCredentials != "" {
+		methods = append(methods, "NATS_CREDENTIALS")
+	}
+	if c.NATSNKeySeedFile != "" {
+		methods = append(methods, "NATS_NKEY_SEED_FILE")
+	}
+	if c.NATSToken != "" {
+		methods = append(methods, "NATS_TOKEN")
+	}
+	if c.NATSUser != "" || c.NATSPassword != "" {
+		methods = append(methods, "NATS_USER/NATS_PASSWORD")
+		if c.NATSUser == "" || c.NATSPassword == "" {
+			errs = append(errs, errors.New("NATS_USER and NATS_PASSWORD must be set together"))
+		}
+	}
+	if len(methods) > 1 {
+		errs = append(errs, fmt.Errorf("only one NATS authentication method may be set, got %s", strings.Join(methods, ", ")))
+	}
+
+	files := []struct{ name, path string }{
+		{"NATS_CREDENTIALS", c.NATSCredentials},
+		{"NATS_NKEY_SEED_FILE", c.NATSNKeySeedFile},
+		{"NATS_TLS_CERT_FILE", c.NATSTLS.CertFile},
+		{"NATS_TLS_KEY_FILE", c.NATSTLS.KeyFile},
+		{"NATS_TLS_CA_FILE", c.NATSTLS.CAFile},
+	}
+	for _, file := range files {
+		if file.path == "" {
+			continue
+		}
+		if err := fileExists(file.path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", file.name, err))
+		}
+	}
+
+	if (c.NATSTLS.CertFile == "") != (c.NATSTLS.KeyFile == "") {
+		errs = append(errs, errors.New("NATS_TLS_CERT_FILE and NATS_TLS_KEY_FILE must be set together"))
+	}
+
+	return errs
+}
+
+func isLiteralSubject(subject string) bool {
+	return subject != "" && !strings.ContainsAny(subject, "*> \t") &&
+		!strings.HasPrefix(subject, ".") && !strings.HasSuffix(subject, ".") && !strings.Contains(subject, "..")
+}
+
+func validateURL(raw string, schemes ...string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host", raw)
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q must use one of the schemes %s", raw, strings.Join(schemes, ", "))
+}
+
+func fileExists(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type envTestConfig struct {
+	Name    string            `yaml:"name"`
+	Enabled bool              `yaml:"enabled"`
+	Count   int               `yaml:"count"`
+	Ratio   float64           `yaml:"ratio"`
+	Timeout time.Duration     `yaml:"timeout"`
+	Backoff []time.Duration   `yaml:"backoff"`
+	Tokens  []string          `yaml:"tokens"`
+	Keys    map[string]string `yaml:"keys"`
+	Ignored string            `yaml:"-"`
+	Outer   struct {
+		Value string `yaml:"value"`
+		Inner struct {
+			Value int `yaml:"value"`
+		} `yaml:"inner_struct"`
+	} `yaml:"outer"`
+}
+
+func TestLoadEnvStruct(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    func(c *envTestConfig)
+		wantErr bool
+	}{
+		{
+			name: "scalars",
+			env:  map[string]string{"NAME": "svc", "ENABLED": "true", "COUNT": "3", "RATIO": "0.5"},
+			want: func(c *envTestConfig) { c.Name, c.Enabled, c.Count, c.Ratio = "svc", true, 3, 0.5 },
+		},
+		{
+			name: "nested struct prefixes",
+			env:  map[string]string{"OUTER_VALUE": "a", "OUTER_INNER_STRUCT_VALUE": "7", "VALUE": "ignored"},
+			want: func(c *envTestConfig) { c.Outer.Value, c.Outer.Inner.Value = "a", 7 },
+		},
+		{
+			name: "duration",
+			env:  map[string]string{"TIMEOUT": "1m30s"},
+			want: func(c *envTestConfig) { c.Timeout = 90 * time.Second },
+		},
+		{
+			name: "slices",
+			env:  map[string]string{"TOKENS": " a, b,,c ", "BACKOFF": "1s,5s"},
+			want: func(c *envTestConfig) {
+				c.Tokens = []string{"a", "b", "c"}
+				c.Backoff = []time.Duration{time.Second, 5 * time.Second}
+			},
+		},
+		{
+			name: "map",
+			env:  map[string]string{"KEYS": "a.example.com=/a.pem, b.example.com = /b.pem"},
+			want: func(c *envTestConfig) {
+				c.Keys = map[string]string{"a.example.com": "/a.pem", "b.example.com": "/b.pem"}
+			},
+		},
+		{
+			name: "skipped field",
+			env:  map[string]string{"IGNORED": "x", "-": "x"},
+			want: func(c *envTestConfig) {},
+		},
+		{name: "invalid duration", env: map[string]string{"TIMEOUT": "30"}, wantErr: true},
+		{name: "invalid duration in slice", env: map[string]string{"BACKOFF": "1s,soon"}, wantErr: true},
+		{name: "invalid int", env: map[string]string{"OUTER_INNER_STRUCT_VALUE": "seven"}, wantErr: true},
+		{name: "invalid bool", env: map[string]string{"ENABLED": "maybe"}, wantErr: true},
+		{name: "invalid map entry", env: map[string]string{"KEYS": "a.example.com"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookup := func(key string) (string, bool) {
+				value, ok := tt.env[key]
+				return value, ok
+			}
+			var got envTestConfig
+			err := loadEnvStruct(reflect.ValueOf(&got).Elem(), "", lookup)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadEnvStruct() error = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var want envTestConfig
+			tt.want(&want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("loadEnvStruct() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadEnvConfig(t *testing.T) {
+	env := map[string]string{
+		"NATS_TLS_CA_FILE":         "/etc/nats/ca.pem",
+		"CONSUMER_BACKOFF":         "10s,1m",
+		"STREAM_SUBJECTS":          "artifact.>",
+		"ARTIFACT_SIGNING_DOMAINS": "tenant.example.com",
+	}
+	var cfg Config
+	err := loadEnv(&cfg, func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.NATSTLS.CAFile != "/etc/nats/ca.pem" {
+		t.Errorf("NATSTLS.CAFile = %q, want /etc/nats/ca.pem", cfg.NATSTLS.CAFile)
+	}
+	if want := []time.Duration{10 * time.Second, time.Minute}; !reflect.DeepEqual(cfg.Consumer.BackOff, want) {
+		t.Errorf("Consumer.BackOff = %v, want %v", cfg.Consumer.BackOff, want)
+	}
+	if want := []string{"artifact.>"}; !reflect.DeepEqual(cfg.Stream.Subjects, want) {
+		t.Errorf("Stream.Subjects = %v, want %v", cfg.Stream.Subjects, want)
+	}
+	if want := []string{"tenant.example.com"}; !reflect.DeepEqual(cfg.Artifact.Signing.Domains, want) {
+		t.Errorf("Artifact.Signing.Domains = %v, want %v", cfg.Artifact.Signing.Domains, want)
+	}
+}
@@ -0,0 +1,93 @@
+package event
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// SchemaVersion is bumped on incompatible changes to Event. It is sent in the
+// payload and in the SchemaVersionHeader header.
+const SchemaVersion = "1"
+
+const (
+	SchemaVersionHeader = "Schema-Version"
+	TypeHeader          = "Event-Type"
+	StatusCodeHeader    = "StatusCode"
+)
+
+type Type string
+
+const (
+	TypeUploadStarted   Type = "upload.started"
+	TypeUploadProgress  Type = "upload.progress"
+	TypeUploadCompleted Type = "upload.completed"
+	TypeUploadFailed    Type = "upload.failed"
+	TypeUploadCancelled Type = "upload.cancelled"
+	TypeCancelResult    Type = "cancel.result"
+	TypeBatchCompleted  Type = "batch.completed"
+	TypeBatchFailed     Type = "batch.failed"
+	TypeSASTokenCreated Type = "sas_token.created"
+	TypeSASTokenFailed  Type = "sas_token.failed"
+	TypeJobStatus       Type = "job.status"
+	TypeJobList         Type = "job.list"
+	TypeUnhandled       Type = "request.unhandled"
+	TypeRetrying        Type = "request.retrying"
+)
+
+type Status string
+
+const (
+	StatusInProgress Status = "in_progress"
+	StatusCompleted  Status = "completed"
+	StatusFailed     Status = "failed"
+	StatusCancelled  Status = "cancelled"
+)
+
+// Event is the envelope of every message the service publishes about a
+// request. Data holds the type specific payload.
+type Event struct {
+	SchemaVersion string    `json:"schemaVersion"`
+	RequestId     string    `json:"requestId"`
+	Type          Type      `json:"type"`
+	Status        Status    `json:"status"`
+	ErrorCode     string    `json:"errorCode,omitempty"`
+	Message       string    `json:"message,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+	Data          any       `json:"data,omitempty"`
+}
+
+func New(requestId string, eventType Type, status Status) Event {
+	return Event{
+		SchemaVersion: SchemaVersion,
+		RequestId:     requestId,
+		Type:          eventType,
+		Status:        status,
+		Timestamp:     time.Now().UTC(),
+	}
+}
+
+func (e Event) WithMessage(message string) Event {
+	e.Message = message
+	return e
+}
+
+func (e Event) WithData(data any) Event {
+	e.Data = data
+	return e
+}
+
+// Msg builds the message publishing e on subject. statusCode is set in the
+// StatusCode header when it is not 0.
+func (e Event) Msg(subject string, statusCode int) *nats.Msg {
+	msg := nats.NewMsg(subject)
+	msg.Header.Set(SchemaVersionHeader, e.SchemaVersion)
+	msg.Header.Set(TypeHeader, string(e.Type))
+	if statusCode != 0 {
+		msg.Header.Set(StatusCodeHeader, strconv.Itoa(statusCode))
+	}
+	msg.Data, _ = json.Marshal(e)
+	return msg
+}
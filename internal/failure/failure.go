@@ -0,0 +1,135 @@
+package failure
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Code is a stable identifier of a failure reported to requesters.
+type Code string
+
+const (
+	CodeInvalidRequest     Code = "INVALID_REQUEST"
+	CodeUnauthorized       Code = "UNAUTHORIZED"
+	CodeBlobNotFound       Code = "BLOB_NOT_FOUND"
+	CodeBlobAccessDenied   Code = "BLOB_ACCESS_DENIED"
+	CodeBlobDownloadFailed Code = "BLOB_DOWNLOAD_FAILED"
+	CodeMenderUnauthorized Code = "MENDER_UNAUTHORIZED"
+	CodeMenderForbidden    Code = "MENDER_FORBIDDEN"
+	CodeMenderConflict     Code = "MENDER_CONFLICT"
+	CodeMenderRejected     Code = "MENDER_REJECTED"
+	CodeMenderUnavailable  Code = "MENDER_UNAVAILABLE"
+	CodeMenderUnreachable  Code = "MENDER_UNREACHABLE"
+	CodeSASTokenFailed     Code = "SAS_TOKEN_FAILED"
+	CodeNotFound           Code = "NOT_FOUND"
+	CodeInvalidArtifact    Code = "INVALID_ARTIFACT"
+	CodeIntegrityError     Code = "INTEGRITY_ERROR"
+	CodeInvalidSignature   Code = "INVALID_SIGNATURE"
+	CodeSigningFailed      Code = "SIGNING_FAILED"
+	CodeTimeout            Code = "TIMEOUT"
+	CodeInternal           Code = "INTERNAL"
+)
+
+// Error classifies a processing error as permanent or transient, with a
+// stable code and the upstream HTTP status code when there is one.
+type Error struct {
+	Code       Code
+	Err        error
+	Permanent  bool
+	StatusCode int
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func Permanent(code Code, err error) error {
+	return &Error{Code: code, Err: err, Permanent: true}
+}
+
+func Transient(code Code, err error) error {
+	return &Error{Code: code, Err: err}
+}
+
+// FromHTTPStatus classifies a failed Mender response. 5xx and 429 responses
+// are transient and every other status is permanent.
+func FromHTTPStatus(statusCode int, err error) error {
+	code := CodeMenderRejected
+	switch {
+	case statusCode == http.StatusUnauthorized:
+		code = CodeMenderUnauthorized
+	case statusCode == http.StatusForbidden:
+		code = CodeMenderForbidden
+	case statusCode == http.StatusConflict:
+		code = CodeMenderConflict
+	case statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError:
+		code = CodeMenderUnavailable
+	}
+
+	return &Error{
+		Code:       code,
+		Err:        err,
+		Permanent:  code != CodeMenderUnavailable,
+		StatusCode: statusCode,
+	}
+}
+
+// IsPermanent reports whether err must not be retried. Unclassified errors are
+// considered transient.
+func IsPermanent(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Permanent
+}
+
+func StatusCode(err error) int {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// CodeOf returns the code of err. Deadlines report TIMEOUT whatever failed
+// and unclassified errors report INTERNAL.
+func CodeOf(err error) Code {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return CodeTimeout
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return CodeInternal
+}
+
+const maxMessageLength = 512
+
+var (
+	urlQuery     = regexp.MustCompile(`(https?://[^\s"'?]+)\?[^\s"']*`)
+	bearerToken  = regexp.MustCompile(`(?i)(bearer\s+)[^\s"']+`)
+	sasSignature = regexp.MustCompile(`(?i)(sig=)[^&\s"']+`)
+)
+
+// Message returns the message of err with URL query strings, bearer tokens
+// and SAS signatures removed, shortened to a bounded length. It is safe to
+// send to requesters.
+func Message(err error) string {
+	if err == nil {
+		return ""
+	}
+	message := err.Error()
+	message = urlQuery.ReplaceAllString(message, "$1")
+	message = bearerToken.ReplaceAllString(message, "${1}[REDACTED]")
+	message = sasSignature.ReplaceAllString(message, "${1}[REDACTED]")
+	if len(message) > maxMessageLength {
+		message = strings.ToValidUTF8(message[:maxMessageLength], "") + "..."
+	}
+	return message
+}
@@ -0,0 +1,188 @@
+package idempotency
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/menderartifactsconsumer/internal/config"
+	"github.com/menderartifactsconsumer/internal/failure"
+	"github.com/menderartifactsconsumer/internal/kvstore"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+type State string
+
+const (
+	StateProcessing State = "processing"
+	StateCompleted  State = "completed"
+	StateFailed     State = "failed"
+	StateCancelled  State = "cancelled"
+)
+
+// ErrInProgress is returned for duplicates of a request another attempt is
+// processing. It is not a failure: the duplicate is acked and the attempt
+// holding the claim reports the outcome.
+var ErrInProgress = errors.New("request is already being processed")
+
+type Result struct {
+	Subject string      `json:"subject"`
+	Header  nats.Header `json:"header,omitempty"`
+	Data    []byte      `json:"data"`
+}
+
+type Record struct {
+	RequestId string    `json:"requestId"`
+	State     State     `json:"state"`
+	Sequence  uint64    `json:"sequence,omitempty"`
+	Result    *Result   `json:"result,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Store keeps one record per request id in a JetStream KV bucket so that a
+// request is processed at most once and duplicates get the stored result.
+type Store struct {
+	kv                jetstream.KeyValue
+	processingTimeout time.Duration
+}
+
+func NewStore(ctx context.Context, js jetstream.JetStream, cfg config.IdempotencyConfig) (*Store, error) {
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:      cfg.Bucket,
+		Description: "Processing state of artifact upload requests",
+		TTL:         cfg.TTL,
+	})
+	if err != nil {
+		log.Printf("Failed to create idempotency bucket %s: %v", cfg.Bucket, err)
+		return nil, err
+	}
+	return &Store{kv: kv, processingTimeout: cfg.ProcessingTimeout}, nil
+}
+
+// Begin claims requestId for processing. It returns claimed=false with the
+// stored record when the request already completed or was cancelled, and
+// ErrInProgress when another attempt claimed it within the processing
+// timeout. Failed and stale records are claimed again, and so are the claims
+// of the stream message with sequence, which is only redelivered once the
+// attempt holding it is gone.
+func (s *Store) Begin(ctx context.Context, requestId string, sequence uint64) (*Record, bool, error) {
+	key := kvstore.Key(requestId)
+	record := Record{RequestId: requestId, State: StateProcessing, Sequence: sequence, UpdatedAt: time.Now().UTC()}
+	value, _ := json.Marshal(record)
+
+	_, err := s.kv.Create(ctx, key, value)
+	if err == nil {
+		return &record, true, nil
+	}
+	if !errors.Is(err, jetstream.ErrKeyExists) {
+		return nil, false, failure.Transient(failure.CodeInternal, fmt.Errorf("claim request %s: %w", requestId, err))
+	}
+
+	entry, err := s.kv.Get(ctx, key)
+	if err != nil {
+		return nil, false, failure.Transient(failure.CodeInternal, fmt.Errorf("get request %s: %w", requestId, err))
+	}
+
+	var existing Record
+	if err := json.Unmarshal(entry.Value(), &existing); err != nil {
+		log.Printf("Discarding unreadable idempotency record for %s: %v", requestId, err)
+	} else {
+		switch {
+		case existing.State == StateCompleted, existing.State == StateCancelled:
+			return &existing, false, nil
+		case existing.State == StateProcessing && time.Since(existing.UpdatedAt) < s.processingTimeout &&
+			(sequence == 0 || existing.Sequence != sequence):
+			return &existing, false, ErrInProgress
+		}
+	}
+
+	if _, err := s.kv.Update(ctx, key, value, entry.Revision()); err != nil {
+		return nil, false, failure.Transient(failure.CodeInternal, fmt.Errorf("reclaim request %s: %w", requestId, err))
+	}
+	return &record, true, nil
+}
+
+func (s *Store) Complete(ctx context.Context, requestId string, response *nats.Msg) error {
+	record := Record{RequestId: requestId, State: StateCompleted, UpdatedAt: time.Now().UTC()}
+	if response != nil {
+		record.Result = &Result{Subject: response.Subject, Header: response.Header, Data: response.Data}
+	}
+	return s.put(ctx, record)
+}
+
+func (s *Store) Cancel(ctx context.Context, requestId string) error {
+	return s.put(ctx, Record{RequestId: requestId, State: StateCancelled, UpdatedAt: time.Now().UTC()})
+}
+
+// CancelPending records requestId as cancelled unless it completed or an
+// attempt is processing it, so that it is not uploaded once it is consumed.
+// It returns the state of the request afterwards.
+func (s *Store) CancelPending(ctx context.Context, requestId string) (State, error) {
+	key := kvstore.Key(requestId)
+	record := Record{RequestId: requestId, State: StateCancelled, UpdatedAt: time.Now().UTC()}
+	value, _ := json.Marshal(record)
+	for {
+		_, err := s.kv.Create(ctx, key, value)
+		if err == nil {
+			return StateCancelled, nil
+		}
+		if !errors.Is(err, jetstream.ErrKeyExists) {
+			return "", fmt.Errorf("cancel request %s: %w", requestId, err)
+		}
+
+		entry, err := s.kv.Get(ctx, key)
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("get request %s: %w", requestId, err)
+		}
+		var existing Record
+		if err := json.Unmarshal(entry.Value(), &existing); err == nil {
+			switch {
+			case existing.State == StateCompleted, existing.State == StateCancelled:
+				return existing.State, nil
+			case existing.State == StateProcessing && time.Since(existing.UpdatedAt) < s.processingTimeout:
+				return existing.State, nil
+			}
+		}
+
+		_, err = s.kv.Update(ctx, key, value, entry.Revision())
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("cancel request %s: %w", requestId, err)
+		}
+		return StateCancelled, nil
+	}
+}
+
+func (s *Store) Fail(ctx context.Context, requestId string, cause error) error {
+	return s.put(ctx, Record{RequestId: requestId, State: StateFailed, Error: failure.Message(cause), UpdatedAt: time.Now().UTC()})
+}
+
+func (s *Store) put(ctx context.Context, record Record) error {
+	value, _ := json.Marshal(record)
+	if _, err := s.kv.Put(ctx, kvstore.Key(record.RequestId), value); err != nil {
+		log.Printf("Failed to store %s state for request %s: %v", record.State, record.RequestId, err)
+		return err
+	}
+	return nil
+}
+
+func (r *Result) Msg() *nats.Msg {
+	msg := nats.NewMsg(r.Subject)
+	for key, values := range r.Header {
+		for _, value := range values {
+			msg.Header.Add(key, value)
+		}
+	}
+	msg.Data = r.Data
+	return msg
+}
@@ -0,0 +1,252 @@
+package jobs
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/menderartifactsconsumer/internal/config"
+	"github.com/menderartifactsconsumer/internal/kvstore"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+type State string
+
+const (
+	StateQueued      State = "queued"
+	StateDownloading State = "downloading"
+	StateUploading   State = "uploading"
+	StateCompleted   State = "completed"
+	StateFailed      State = "failed"
+	StateCancelled   State = "cancelled"
+)
+
+var ErrNotFound = errors.New("job not found")
+
+// Job is the persisted lifecycle of one upload request. Timestamps holds when
+// the job last entered each state.
+type Job struct {
+	RequestId        string              `json:"requestId"`
+	Domain           string              `json:"domain"`
+	ContainerName    string              `json:"containerName"`
+	BlobName         string              `json:"blobName"`
+	State            State               `json:"state"`
+	Attempts         int                 `json:"attempts"`
+	MenderStatusCode int                 `json:"menderStatusCode,omitempty"`
+	Error            string              `json:"error,omitempty"`
+	CreatedAt        time.Time           `json:"createdAt"`
+	UpdatedAt        time.Time           `json:"updatedAt"`
+	Timestamps       map[State]time.Time `json:"timestamps"`
+}
+
+type Filter struct {
+	Domain string    `json:"domain,omitempty"`
+	From   time.Time `json:"from,omitempty"`
+	To     time.Time `json:"to,omitempty"`
+	Limit  int       `json:"limit,omitempty"`
+}
+
+// Store persists jobs in a JetStream KV bucket keyed by request id.
+type Store struct {
+	kv jetstream.KeyValue
+}
+
+func NewStore(ctx context.Context, js jetstream.JetStream, cfg config.JobsConfig) (*Store, error) {
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:      cfg.Bucket,
+		Description: "Lifecycle of artifact upload jobs",
+		TTL:         cfg.TTL,
+	})
+	if err != nil {
+		log.Printf("Failed to create jobs bucket %s: %v", cfg.Bucket, err)
+		return nil, err
+	}
+	return &Store{kv: kv}, nil
+}
+
+// Transition moves the job of requestId to state, creating it when needed,
+// and applies update to it before it is stored.
+func (s *Store) Transition(ctx context.Context, requestId string, state State, update func(*Job)) error {
+	_, err := s.transition(ctx, requestId, state, nil, update)
+	return err
+}
+
+// Queue moves the job of requestId to queued when it is new or failed, so
+// that a late record never resets a job already running, completed or
+// cancelled. It reports whether the job was queued.
+func (s *Store) Queue(ctx context.Context, requestId string, update func(*Job)) (bool, error) {
+	return s.transition(ctx, requestId, StateQueued, func(job *Job, exists bool) bool {
+		return !exists || job.State == StateFailed
+	}, update)
+}
+
+// Cancel moves the job of requestId to cancelled when it is new, queued or
+// failed. It reports whether the job was cancelled.
+func (s *Store) Cancel(ctx context.Context, requestId string) (bool, error) {
+	return s.transition(ctx, requestId, StateCancelled, func(job *Job, exists bool) bool {
+		return !exists || job.State == StateQueued || job.State == StateFailed
+	}, nil)
+}
+
+// transition stores the job of requestId in state when allow, if set,
+// accepts the current job. The check and the update are atomic.
+func (s *Store) transition(ctx context.Context, requestId string, state State, allow func(job *Job, exists bool) bool, update func(*Job)) (bool, error) {
+	key := kvstore.Key(requestId)
+	for {
+		now := time.Now().UTC()
+		job := Job{RequestId: requestId, CreatedAt: now}
+		var revision uint64
+
+		entry, err := s.kv.Get(ctx, key)
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(entry.Value(), &job); err != nil {
+				log.Printf("Replacing unreadable job %s: %v", requestId, err)
+				job = Job{RequestId: requestId, CreatedAt: now}
+			}
+			revision = entry.Revision()
+		case !errors.Is(err, jetstream.ErrKeyNotFound):
+			return false, fmt.Errorf("get job %s: %w", requestId, err)
+		}
+		if allow != nil && !allow(&job, revision != 0) {
+			return false, nil
+		}
+
+		if job.Timestamps == nil {
+			job.Timestamps = make(map[State]time.Time)
+		}
+		job.State = state
+		job.UpdatedAt = now
+		job.Timestamps[state] = now
+		if update != nil {
+			update(&job)
+		}
+
+		value, _ := json.Marshal(job)
+		if revision == 0 {
+			_, err = s.kv.Create(ctx, key, value)
+		} else {
+			_, err = s.kv.Update(ctx, key, value, revision)
+		}
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("store job %s: %w", requestId, err)
+		}
+		return true, nil
+	}
+}
+
+func (s *Store) Get(ctx context.Context, requestId string) (*Job, error) {
+	entry, err := s.kv.Get(ctx, kvstore.Key(requestId))
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var job Job
+	if err := json.Unmarshal(entry.Value(), &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+const (
+	// DefaultListLimit is the number of jobs List returns without a limit.
+	DefaultListLimit = 100
+	// MaxListLimit bounds the number of jobs List returns.
+	MaxListLimit = 1000
+)
+
+// List returns the jobs matching filter, most recently created first. The
+// current values of the bucket are read in one pass with a watcher instead
+// of a Get per key, and only the newest limit matching jobs are kept while
+// iterating.
+func (s *Store) List(ctx context.Context, filter Filter) ([]Job, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	limit = min(limit, MaxListLimit)
+
+	watcher, err := s.kv.WatchAll(ctx, jetstream.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	defer watcher.Stop()
+
+	newest := newestJobs{limit: limit}
+	for {
+		select {
+		case entry := <-watcher.Updates():
+			// A nil entry follows the current values.
+			if entry == nil {
+				return newest.jobs(), nil
+			}
+			var job Job
+			if err := json.Unmarshal(entry.Value(), &job); err != nil || !filter.matches(job) {
+				continue
+			}
+			newest.add(job)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// newestJobs keeps the limit most recently created of the jobs added to it.
+type newestJobs struct {
+	limit int
+	heap  jobHeap
+}
+
+func (n *newestJobs) add(job Job) {
+	heap.Push(&n.heap, job)
+	if n.heap.Len() > n.limit {
+		heap.Pop(&n.heap)
+	}
+}
+
+// jobs returns the kept jobs, most recently created first.
+func (n *newestJobs) jobs() []Job {
+	jobs := make([]Job, n.heap.Len())
+	for i := len(jobs) - 1; i >= 0; i-- {
+		jobs[i] = heap.Pop(&n.heap).(Job)
+	}
+	return jobs
+}
+
+// jobHeap keeps the oldest job on top, so that it is dropped first.
+type jobHeap []Job
+
+func (h jobHeap) Len() int           { return len(h) }
+func (h jobHeap) Less(i, j int) bool { return h[i].CreatedAt.Before(h[j].CreatedAt) }
+func (h jobHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *jobHeap) Push(x any)        { *h = append(*h, x.(Job)) }
+
+func (h *jobHeap) Pop() any {
+	old := *h
+	job := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return job
+}
+
+func (f Filter) matches(job Job) bool {
+	if f.Domain != "" && job.Domain != f.Domain {
+		return false
+	}
+	if !f.From.IsZero() && job.CreatedAt.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && job.CreatedAt.After(f.To) {
+		return false
+	}
+	return true
+}
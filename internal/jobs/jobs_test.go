@@ -0,0 +1,67 @@
+package jobs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFilterMatches(t *testing.T) {
+	created := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	job := Job{RequestId: "abc", Domain: "tenant.example.com", CreatedAt: created}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   bool
+	}{
+		{name: "empty", want: true},
+		{name: "domain", filter: Filter{Domain: "tenant.example.com"}, want: true},
+		{name: "other domain", filter: Filter{Domain: "other.example.com"}},
+		{name: "within range", filter: Filter{From: created.Add(-time.Hour), To: created.Add(time.Hour)}, want: true},
+		{name: "range bounds", filter: Filter{From: created, To: created}, want: true},
+		{name: "before from", filter: Filter{From: created.Add(time.Second)}},
+		{name: "after to", filter: Filter{To: created.Add(-time.Second)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.matches(job); got != tt.want {
+				t.Errorf("matches() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewestJobs(t *testing.T) {
+	start := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+	// Jobs are added in key order, not in creation order.
+	order := []int{3, 0, 5, 1, 4, 2}
+
+	tests := []struct {
+		limit int
+		want  []string
+	}{
+		{limit: 1, want: []string{"job-5"}},
+		{limit: 3, want: []string{"job-5", "job-4", "job-3"}},
+		{limit: 10, want: []string{"job-5", "job-4", "job-3", "job-2", "job-1", "job-0"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.limit), func(t *testing.T) {
+			newest := newestJobs{limit: tt.limit}
+			for _, i := range order {
+				newest.add(Job{RequestId: fmt.Sprintf("job-%d", i), CreatedAt: start.Add(time.Duration(i) * time.Hour)})
+			}
+			jobs := newest.jobs()
+			if len(jobs) != len(tt.want) {
+				t.Fatalf("got %d jobs, want %d", len(jobs), len(tt.want))
+			}
+			for i, job := range jobs {
+				if job.RequestId != tt.want[i] {
+					t.Errorf("jobs[%d] = %s, want %s", i, job.RequestId, tt.want[i])
+				}
+			}
+		})
+	}
+}
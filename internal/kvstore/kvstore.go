@@ -0,0 +1,17 @@
+package kvstore
+
+import (
+	"encoding/base64"
+	"regexp"
+)
+
+var validKey = regexp.MustCompile(`^[-/_=\.a-zA-Z0-9]+$`)
+
+// Key returns id when it is a valid JetStream KV key and a prefixed base64
+// encoding of it otherwise.
+func Key(id string) string {
+	if validKey.MatchString(id) && id[0] != '.' && id[len(id)-1] != '.' {
+		return id
+	}
+	return "b64." + base64.RawURLEncoding.EncodeToString([]byte(id))
+}
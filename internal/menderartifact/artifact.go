@@ -0,0 +1,485 @@
+package menderartifact
+
+import (
+	"archive/tar"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Sections of an artifact, reported by FormatError.
+const (
+	SectionVersion   = "version"
+	SectionManifest  = "manifest"
+	SectionSignature = "manifest.sig"
+	SectionHeader    = "header"
+	SectionData      = "data"
+)
+
+// maxMetadataSize bounds the files that are read in memory: version,
+// manifest, signatures and the JSON files of the header.
+const maxMetadataSize = 1 << 20
+
+// FormatError reports an artifact that is not a valid Mender artifact and
+// the section where that was detected.
+type FormatError struct {
+	Section string
+	Err     error
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("invalid artifact %s: %v", e.Section, e.Err)
+}
+
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+func formatErrorf(section, format string, args ...any) error {
+	return &FormatError{Section: section, Err: fmt.Errorf(format, args...)}
+}
+
+// ChecksumError reports a file whose SHA-256 checksum differs from the one
+// it was expected to have, usually an artifact corrupted in storage or in
+// transfer.
+type ChecksumError struct {
+	Name     string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch for %s: expected %s, got %s", e.Name, e.Expected, e.Actual)
+}
+
+type versionInfo struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+// Copy copies the Mender artifact read from src to dst and validates its
+// structure while it streams: the version, the manifest, the header archive
+// and the data archives, in that order, and verifies the version, header and
+// payload files against the checksums of the manifest. Bytes are written to
+// dst as soon as they are read, so a malformed or corrupted artifact is
+// reported before its end reaches dst. It returns the metadata of the
+// artifact. With a Signer, the manifest.sig written to dst is replaced by a
+// new signature. Errors reading src or writing dst are returned as they are,
+// checksum mismatches are a *ChecksumError, rejected signatures a
+// *SignatureError, signing failures a *SigningError and every other error is
+// a *FormatError.
+func Copy(dst io.Writer, src io.Reader, opts Options) (*Metadata, error) {
+	if opts.Signer != nil {
+		return copySigned(dst, src, opts)
+	}
+
+	in := &errReader{r: src}
+	out := &errWriter{w: dst}
+	tee := io.TeeReader(in, out)
+
+	p := &parser{opts: opts}
+	err := p.parse(tar.NewReader(tee))
+	if err == nil {
+		// Forward the end of archive blocks and any trailing padding.
+		_, err = io.Copy(io.Discard, tee)
+	}
+	switch {
+	case in.err != nil:
+		return nil, in.err
+	case out.err != nil:
+		return nil, out.err
+	case err != nil:
+		return nil, err
+	}
+	p.metadata.Size = in.n
+	return &p.metadata, nil
+}
+
+// Options sets how Copy treats the signature of artifacts. Signatures are
+// verified against PublicKeys when VerifySignature is set, and unsigned
+// artifacts are rejected when RequireSignature is set as well. Artifacts are
+// signed with Signer when it is set, once their original signature passed
+// the other options.
+type Options struct {
+	VerifySignature  bool
+	RequireSignature bool
+	PublicKeys       []PublicKey
+	Signer           crypto.Signer
+}
+
+type parser struct {
+	opts     Options
+	version  int
+	manifest map[string]string
+	augment  map[string]string
+	verified map[string]bool
+	metadata Metadata
+}
+
+func (p *parser) parse(tr *tar.Reader) error {
+	hdr, err := next(tr, SectionVersion)
+	if err != nil {
+		return err
+	}
+	if hdr.Name != "version" {
+		return formatErrorf(SectionVersion, "first entry is %q instead of version", hdr.Name)
+	}
+	// The version precedes the manifest listing its checksum.
+	versionSum := sha256.New()
+	if err := p.readVersion(io.TeeReader(tr, versionSum)); err != nil {
+		return err
+	}
+
+	if hdr, err = next(tr, SectionManifest); err != nil {
+		return err
+	}
+	if hdr.Name != "manifest" {
+		return formatErrorf(SectionManifest, "entry %q found instead of manifest", hdr.Name)
+	}
+	manifest, err := readMetadata(tr, SectionManifest)
+	if err != nil {
+		return err
+	}
+	if p.manifest, err = parseChecksums(manifest); err != nil {
+		return err
+	}
+	p.verified = make(map[string]bool)
+	if err := p.verify("version", SectionManifest, versionSum.Sum(nil)); err != nil {
+		return err
+	}
+
+	if hdr, err = next(tr, SectionHeader); err != nil {
+		return err
+	}
+	if hdr.Name == "manifest.sig" {
+		signature, err := readMetadata(tr, SectionSignature)
+		if err != nil {
+			return err
+		}
+		if p.opts.VerifySignature {
+			key, err := verifySignature(manifest, signature, p.opts.PublicKeys)
+			if err != nil {
+				return err
+			}
+			p.metadata.SigningKeyFingerprint = key.Fingerprint
+		}
+		if hdr, err = next(tr, SectionHeader); err != nil {
+			return err
+		}
+	} else if p.opts.VerifySignature && p.opts.RequireSignature {
+		return &SignatureError{Err: ErrUnsigned}
+	}
+	if hdr.Name == "manifest-augment" {
+		augment, err := readMetadata(tr, SectionManifest)
+		if err != nil {
+			return err
+		}
+		if err := p.parseAugment(augment); err != nil {
+			return err
+		}
+		if hdr, err = next(tr, SectionHeader); err != nil {
+			return err
+		}
+	}
+
+	base, ext, ok := splitArchive(hdr.Name)
+	if !ok || base != "header" {
+		return formatErrorf(SectionHeader, "entry %q found instead of header.tar", hdr.Name)
+	}
+	err = p.readChecked(tr, hdr.Name, SectionHeader, func(r io.Reader) error {
+		return p.readHeader(r, ext)
+	})
+	if err != nil {
+		return err
+	}
+
+	index := 0
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return &FormatError{Section: SectionData, Err: err}
+		}
+		base, ext, ok := splitArchive(hdr.Name)
+		if ok && base == "header-augment" && index == 0 {
+			err := p.readChecked(tr, hdr.Name, SectionHeader, func(r io.Reader) error {
+				return readArchive(r, ext, SectionHeader, nil)
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !ok || base != fmt.Sprintf("data/%04d", index) {
+			return formatErrorf(SectionData, "entry %q found instead of data/%04d.tar", hdr.Name, index)
+		}
+		if index >= len(p.metadata.Payloads) {
+			return formatErrorf(SectionData, "data/%04d has no payload in the header", index)
+		}
+		p.metadata.Payloads[index].ArchiveSize = hdr.Size
+		if err := p.readData(tr, ext, index); err != nil {
+			return err
+		}
+		index++
+	}
+
+	if index != len(p.metadata.Payloads) {
+		return formatErrorf(SectionData, "artifact has %d payloads, its header lists %d", index, len(p.metadata.Payloads))
+	}
+	for name := range p.manifest {
+		if !p.verified[name] {
+			return formatErrorf(SectionManifest, "manifest lists %s which is not in the artifact", name)
+		}
+	}
+	for name := range p.augment {
+		if !p.verified[name] {
+			return formatErrorf(SectionManifest, "manifest-augment lists %s which is not in the artifact", name)
+		}
+	}
+	return nil
+}
+
+func (p *parser) readVersion(r io.Reader) error {
+	data, err := readMetadata(r, SectionVersion)
+	if err != nil {
+		return err
+	}
+	var info versionInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return &FormatError{Section: SectionVersion, Err: err}
+	}
+	if info.Format != "mender" {
+		return formatErrorf(SectionVersion, "format is %q instead of mender", info.Format)
+	}
+	if info.Version != 2 && info.Version != 3 {
+		return formatErrorf(SectionVersion, "unsupported version %d", info.Version)
+	}
+	p.version = info.Version
+	p.metadata.FormatVersion = info.Version
+	return nil
+}
+
+// parseChecksums parses the "<sha256>  <path>" lines of a manifest.
+func parseChecksums(data []byte) (map[string]string, error) {
+	checksums := make(map[string]string)
+	for i, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, formatErrorf(SectionManifest, "line %d is not a checksum and a file name", i+1)
+		}
+		sum, name := fields[0], fields[1]
+		if decoded, err := hex.DecodeString(sum); err != nil || len(decoded) != 32 {
+			return nil, formatErrorf(SectionManifest, "line %d has no SHA-256 checksum", i+1)
+		}
+		checksums[name] = strings.ToLower(sum)
+	}
+	return checksums, nil
+}
+
+// parseAugment parses the manifest-augment. It is not covered by the
+// signature, so it may only list the header-augment and augmented payload
+// files, never a file of the signed manifest.
+func (p *parser) parseAugment(data []byte) error {
+	augment, err := parseChecksums(data)
+	if err != nil {
+		return err
+	}
+	for name := range augment {
+		if _, ok := p.manifest[name]; ok {
+			return formatErrorf(SectionManifest, "manifest-augment lists %s of the manifest", name)
+		}
+		base, _, ok := splitArchive(name)
+		if !(ok && base == "header-augment") && !strings.HasPrefix(name, "data/") {
+			return formatErrorf(SectionManifest, "manifest-augment lists %s which cannot be augmented", name)
+		}
+	}
+	p.augment = augment
+	return nil
+}
+
+// readChecked calls read with the file name of the outer archive and
+// verifies its checksum against the manifest, including the bytes read
+// leaves unread.
+func (p *parser) readChecked(r io.Reader, name, section string, read func(io.Reader) error) error {
+	h := sha256.New()
+	tee := io.TeeReader(r, h)
+	if err := read(tee); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return &FormatError{Section: section, Err: err}
+	}
+	return p.verify(name, section, h.Sum(nil))
+}
+
+// verify compares the checksum of the file name with the manifest, or with
+// the manifest-augment for files the manifest does not list. A file listed in
+// neither is malformed rather than corrupted.
+func (p *parser) verify(name, section string, sum []byte) error {
+	actual := hex.EncodeToString(sum)
+	expected, ok := p.manifest[name]
+	if !ok {
+		expected, ok = p.augment[name]
+	}
+	if !ok {
+		return formatErrorf(section, "%s is not listed in the manifest", name)
+	}
+	if expected != actual {
+		return &ChecksumError{Name: name, Expected: expected, Actual: actual}
+	}
+	p.verified[name] = true
+	return nil
+}
+
+func (p *parser) readHeader(r io.Reader, ext string) error {
+	typeInfos := 0
+	err := readArchive(r, ext, SectionHeader, func(i int, hdr *tar.Header, tr *tar.Reader) error {
+		switch {
+		case i == 0:
+			if hdr.Name != "header-info" {
+				return formatErrorf(SectionHeader, "first entry is %q instead of header-info", hdr.Name)
+			}
+			return p.readHeaderInfo(tr)
+		case strings.HasSuffix(hdr.Name, "/type-info"):
+			typeInfos++
+			data, err := readMetadata(tr, SectionHeader)
+			if err != nil {
+				return err
+			}
+			if err := p.metadata.applyTypeInfo(hdr.Name, data); err != nil {
+				return &FormatError{Section: SectionHeader, Err: err}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if p.version >= 3 && typeInfos != len(p.metadata.Payloads) {
+		return formatErrorf(SectionHeader, "header has %d type-info files for %d payloads", typeInfos, len(p.metadata.Payloads))
+	}
+	return nil
+}
+
+func (p *parser) readHeaderInfo(r io.Reader) error {
+	data, err := readMetadata(r, SectionHeader)
+	if err != nil {
+		return err
+	}
+	if err := p.metadata.applyHeaderInfo(p.version, data); err != nil {
+		return formatErrorf(SectionHeader, "header-info: %v", err)
+	}
+	return nil
+}
+
+func (p *parser) readData(r io.Reader, ext string, index int) error {
+	return readArchive(r, ext, SectionData, func(i int, hdr *tar.Header, tr *tar.Reader) error {
+		if hdr.Typeflag != tar.TypeReg {
+			return formatErrorf(SectionData, "data/%04d entry %q is not a regular file", index, hdr.Name)
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, tr)
+		if err != nil {
+			return &FormatError{Section: SectionData, Err: err}
+		}
+		if err := p.verify(fmt.Sprintf("data/%04d/%s", index, hdr.Name), SectionData, h.Sum(nil)); err != nil {
+			return err
+		}
+		payload := &p.metadata.Payloads[index]
+		payload.Files = append(payload.Files, File{Name: hdr.Name, Size: n})
+		payload.Size += n
+		return nil
+	})
+}
+
+// readArchive decompresses the tar archive r with the extension ext and
+// calls entry for each of its entries. The compressed stream is read to its
+// end so that its checksum is verified.
+func readArchive(r io.Reader, ext, section string, entry func(i int, hdr *tar.Header, tr *tar.Reader) error) error {
+	decompressed, err := decompress(r, ext)
+	if err != nil {
+		return &FormatError{Section: section, Err: err}
+	}
+	defer decompressed.Close()
+
+	tr := tar.NewReader(decompressed)
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return &FormatError{Section: section, Err: err}
+		}
+		if entry != nil {
+			if err := entry(i, hdr, tr); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := io.Copy(io.Discard, decompressed); err != nil {
+		return &FormatError{Section: section, Err: err}
+	}
+	return nil
+}
+
+func readMetadata(r io.Reader, section string) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxMetadataSize+1))
+	if err != nil {
+		return nil, &FormatError{Section: section, Err: err}
+	}
+	if len(data) > maxMetadataSize {
+		return nil, formatErrorf(section, "file is larger than %d bytes", maxMetadataSize)
+	}
+	return data, nil
+}
+
+// next returns the next entry of the outer archive, which must exist and
+// belong to section.
+func next(tr *tar.Reader, section string) (*tar.Header, error) {
+	hdr, err := tr.Next()
+	if errors.Is(err, io.EOF) {
+		return nil, formatErrorf(section, "artifact ends before its %s", section)
+	}
+	if err != nil {
+		return nil, &FormatError{Section: section, Err: err}
+	}
+	return hdr, nil
+}
+
+// errReader and errWriter keep the errors of the underlying reader and
+// writer apart from the format errors they cause in the tar reader.
+type errReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *errWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,365 @@
+package menderartifact
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+type entry struct {
+	name string
+	data []byte
+}
+
+func tarArchive(t *testing.T, entries ...entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.data)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func compress(t *testing.T, ext string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	switch ext {
+	case "":
+		return data
+	case ".gz":
+		w := gzip.NewWriter(&buf)
+		if _, err = w.Write(data); err == nil {
+			err = w.Close()
+		}
+	case ".xz":
+		var w *xz.Writer
+		if w, err = xz.NewWriter(&buf); err == nil {
+			if _, err = w.Write(data); err == nil {
+				err = w.Close()
+			}
+		}
+	case ".zst":
+		var w *zstd.Encoder
+		if w, err = zstd.NewWriter(&buf); err == nil {
+			if _, err = w.Write(data); err == nil {
+				err = w.Close()
+			}
+		}
+	default:
+		t.Fatalf("unknown compression %q", ext)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// testArtifact describes a small generated artifact with one file per
+// payload.
+type testArtifact struct {
+	version  int
+	ext      string
+	payloads []string
+}
+
+// entries returns the entries of the outer archive of the artifact, with a
+// manifest listing every file.
+func (a testArtifact) entries(t *testing.T) []entry {
+	t.Helper()
+	version := []byte(fmt.Sprintf(`{"format": "mender", "version": %d}`, a.version))
+
+	var headerInfo string
+	if a.version < 3 {
+		headerInfo = `{"updates": [` + repeat(`{"type": "rootfs-image"}`, len(a.payloads)) + `], "artifact_name": "release-1", "device_types_compatible": ["qemu"]}`
+	} else {
+		headerInfo = `{"payloads": [` + repeat(`{"type": "rootfs-image"}`, len(a.payloads)) + `], "artifact_provides": {"artifact_name": "release-1"}, "artifact_depends": {"device_type": ["qemu"]}}`
+	}
+	header := []entry{{name: "header-info", data: []byte(headerInfo)}}
+	for i := range a.payloads {
+		header = append(header, entry{
+			name: fmt.Sprintf("headers/%04d/type-info", i),
+			data: []byte(`{"type": "rootfs-image", "artifact_provides": {"rootfs-image.version": "1"}}`),
+		})
+	}
+	headerArchive := compress(t, a.ext, tarArchive(t, header...))
+
+	var manifest bytes.Buffer
+	fmt.Fprintf(&manifest, "%s  version\n", checksum(version))
+	fmt.Fprintf(&manifest, "%s  header.tar%s\n", checksum(headerArchive), a.ext)
+	var data []entry
+	for i, payload := range a.payloads {
+		fmt.Fprintf(&manifest, "%s  data/%04d/rootfs.ext4\n", checksum([]byte(payload)), i)
+		data = append(data, entry{
+			name: fmt.Sprintf("data/%04d.tar%s", i, a.ext),
+			data: compress(t, a.ext, tarArchive(t, entry{name: "rootfs.ext4", data: []byte(payload)})),
+		})
+	}
+
+	entries := []entry{
+		{name: "version", data: version},
+		{name: "manifest", data: manifest.Bytes()},
+		{name: "header.tar" + a.ext, data: headerArchive},
+	}
+	return append(entries, data...)
+}
+
+func repeat(s string, n int) string {
+	var b bytes.Buffer
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(s)
+	}
+	return b.String()
+}
+
+// insertAfter returns entries with extra inserted after the entry name.
+func insertAfter(entries []entry, name string, extra ...entry) []entry {
+	for i, e := range entries {
+		if e.name == name {
+			result := append([]entry{}, entries[:i+1]...)
+			result = append(result, extra...)
+			return append(result, entries[i+1:]...)
+		}
+	}
+	return entries
+}
+
+func find(entries []entry, name string) []byte {
+	for _, e := range entries {
+		if e.name == name {
+			return e.data
+		}
+	}
+	return nil
+}
+
+func errorKind(err error) string {
+	var formatErr *FormatError
+	var checksumErr *ChecksumError
+	var signatureErr *SignatureError
+	var signingErr *SigningError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &signatureErr):
+		return "signature"
+	case errors.As(err, &signingErr):
+		return "signing"
+	case errors.As(err, &checksumErr):
+		return "checksum"
+	case errors.As(err, &formatErr):
+		return "format"
+	}
+	return fmt.Sprintf("unexpected %T", err)
+}
+
+func TestCopy(t *testing.T) {
+	v3 := testArtifact{version: 3, ext: ".gz", payloads: []string{"rootfs"}}
+
+	tests := []struct {
+		name     string
+		artifact testArtifact
+		modify   func(t *testing.T, entries []entry) []entry
+		truncate bool
+		want     string
+	}{
+		{name: "v3 gz", artifact: v3},
+		{name: "v3 xz", artifact: testArtifact{version: 3, ext: ".xz", payloads: []string{"rootfs"}}},
+		{name: "v3 zst", artifact: testArtifact{version: 3, ext: ".zst", payloads: []string{"rootfs"}}},
+		{name: "v3 tar", artifact: testArtifact{version: 3, payloads: []string{"rootfs"}}},
+		{name: "v3 two payloads", artifact: testArtifact{version: 3, ext: ".gz", payloads: []string{"rootfs", "app"}}},
+		{name: "v2 gz", artifact: testArtifact{version: 2, ext: ".gz", payloads: []string{"rootfs"}}},
+		{
+			name:     "truncated",
+			artifact: v3,
+			truncate: true,
+			want:     "format",
+		},
+		{
+			name:     "truncated data archive",
+			artifact: v3,
+			modify: func(t *testing.T, entries []entry) []entry {
+				entries[3].data = entries[3].data[:len(entries[3].data)-10]
+				return entries
+			},
+			want: "format",
+		},
+		{
+			name:     "invalid version",
+			artifact: v3,
+			modify: func(t *testing.T, entries []entry) []entry {
+				return []entry{{name: "version", data: []byte("not json")}}
+			},
+			want: "format",
+		},
+		{
+			name:     "unsupported version",
+			artifact: testArtifact{version: 1, ext: ".gz", payloads: []string{"rootfs"}},
+			want:     "format",
+		},
+		{
+			name:     "manifest after header",
+			artifact: v3,
+			modify: func(t *testing.T, entries []entry) []entry {
+				return []entry{entries[0], entries[2], entries[1], entries[3]}
+			},
+			want: "format",
+		},
+		{
+			name:     "data before header",
+			artifact: v3,
+			modify: func(t *testing.T, entries []entry) []entry {
+				return []entry{entries[0], entries[1], entries[3], entries[2]}
+			},
+			want: "format",
+		},
+		{
+			name:     "missing payload",
+			artifact: testArtifact{version: 3, ext: ".gz", payloads: []string{"rootfs", "app"}},
+			modify: func(t *testing.T, entries []entry) []entry {
+				return entries[:len(entries)-1]
+			},
+			want: "format",
+		},
+		{
+			name:     "extra payload",
+			artifact: v3,
+			modify: func(t *testing.T, entries []entry) []entry {
+				extra := entry{name: "data/0001.tar.gz", data: compress(t, ".gz", tarArchive(t, entry{name: "app", data: []byte("app")}))}
+				return append(entries, extra)
+			},
+			want: "format",
+		},
+		{
+			name:     "corrupted payload",
+			artifact: v3,
+			modify: func(t *testing.T, entries []entry) []entry {
+				entries[3].data = compress(t, ".gz", tarArchive(t, entry{name: "rootfs.ext4", data: []byte("tampered")}))
+				return entries
+			},
+			want: "checksum",
+		},
+		{
+			name:     "corrupted version",
+			artifact: v3,
+			modify: func(t *testing.T, entries []entry) []entry {
+				entries[0].data = []byte(`{"format":"mender","version":3}`)
+				return entries
+			},
+			want: "checksum",
+		},
+		{
+			name:     "file not in manifest",
+			artifact: v3,
+			modify: func(t *testing.T, entries []entry) []entry {
+				entries[3].data = compress(t, ".gz", tarArchive(t,
+					entry{name: "rootfs.ext4", data: []byte("rootfs")},
+					entry{name: "extra", data: []byte("extra")}))
+				return entries
+			},
+			want: "format",
+		},
+		{
+			name:     "header-augment listed in manifest-augment",
+			artifact: v3,
+			modify: func(t *testing.T, entries []entry) []entry {
+				headerAugment := compress(t, ".gz", tarArchive(t, entry{name: "header-info", data: []byte(`{}`)}))
+				augment := fmt.Sprintf("%s  header-augment.tar.gz\n", checksum(headerAugment))
+				entries = insertAfter(entries, "manifest", entry{name: "manifest-augment", data: []byte(augment)})
+				return insertAfter(entries, "header.tar.gz", entry{name: "header-augment.tar.gz", data: headerAugment})
+			},
+		},
+		{
+			name:     "manifest-augment overriding the manifest",
+			artifact: v3,
+			modify: func(t *testing.T, entries []entry) []entry {
+				augment := fmt.Sprintf("%s  data/0000/rootfs.ext4\n", checksum([]byte("tampered")))
+				entries[3].data = compress(t, ".gz", tarArchive(t, entry{name: "rootfs.ext4", data: []byte("tampered")}))
+				return insertAfter(entries, "manifest", entry{name: "manifest-augment", data: []byte(augment)})
+			},
+			want: "format",
+		},
+		{
+			name:     "manifest-augment listing the header",
+			artifact: v3,
+			modify: func(t *testing.T, entries []entry) []entry {
+				augment := fmt.Sprintf("%s  header.tar\n", checksum([]byte("header")))
+				return insertAfter(entries, "manifest", entry{name: "manifest-augment", data: []byte(augment)})
+			},
+			want: "format",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := tt.artifact.entries(t)
+			if tt.modify != nil {
+				entries = tt.modify(t, entries)
+			}
+			artifact := tarArchive(t, entries...)
+			if tt.truncate {
+				artifact = artifact[:len(artifact)/2]
+			}
+
+			var dst bytes.Buffer
+			metadata, err := Copy(&dst, bytes.NewReader(artifact), Options{})
+			if kind := errorKind(err); kind != tt.want {
+				t.Fatalf("Copy() error = %v, want %s error", err, or(tt.want, "no"))
+			}
+			if err != nil {
+				return
+			}
+
+			if !bytes.Equal(dst.Bytes(), artifact) {
+				t.Error("Copy() did not copy the artifact unchanged")
+			}
+			if metadata.FormatVersion != tt.artifact.version {
+				t.Errorf("FormatVersion = %d, want %d", metadata.FormatVersion, tt.artifact.version)
+			}
+			if metadata.ArtifactName != "release-1" {
+				t.Errorf("ArtifactName = %q, want release-1", metadata.ArtifactName)
+			}
+			if len(metadata.Payloads) != len(tt.artifact.payloads) {
+				t.Fatalf("got %d payloads, want %d", len(metadata.Payloads), len(tt.artifact.payloads))
+			}
+			for i, payload := range tt.artifact.payloads {
+				if got := metadata.Payloads[i].Size; got != int64(len(payload)) {
+					t.Errorf("payload %d size = %d, want %d", i, got, len(payload))
+				}
+			}
+		})
+	}
+}
+
+func or(s, fallback string) string {
+	if s == "" {
+		return fallback
+	}
+	return s
+}
@@ -0,0 +1,61 @@
+package menderartifact
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// compressions maps the extensions of header and data archives to their
+// decompressors. An archive without extension is a plain tar.
+var compressions = map[string]func(io.Reader) (io.ReadCloser, error){
+	"": func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(r), nil
+	},
+	".gz": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	".xz": func(r io.Reader) (io.ReadCloser, error) {
+		reader, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(reader), nil
+	},
+	".zst": func(r io.Reader) (io.ReadCloser, error) {
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	},
+}
+
+// splitArchive splits name into the archive name without compression
+// extension and that extension. ok is false for unknown extensions.
+func splitArchive(name string) (base, ext string, ok bool) {
+	base, ok = strings.CutSuffix(name, ".tar")
+	if ok {
+		return base, "", true
+	}
+	for ext := range compressions {
+		if ext != "" {
+			if base, ok := strings.CutSuffix(name, ".tar"+ext); ok {
+				return base, ext, true
+			}
+		}
+	}
+	return name, "", false
+}
+
+func decompress(r io.Reader, ext string) (io.ReadCloser, error) {
+	open, ok := compressions[ext]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression %q", ext)
+	}
+	return open(r)
+}
@@ -0,0 +1,145 @@
+package menderartifact
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Metadata describes a parsed artifact. Provides and Depends hold the
+// artifact level fields of the header; payloads carry their own.
+// SigningKeyFingerprint is set when the signature of the artifact was
+// verified.
+type Metadata struct {
+	FormatVersion         int               `json:"formatVersion"`
+	ArtifactName          string            `json:"artifactName"`
+	ArtifactGroup         string            `json:"artifactGroup,omitempty"`
+	DeviceTypesCompatible []string          `json:"deviceTypesCompatible"`
+	Provides              map[string]string `json:"provides,omitempty"`
+	Depends               map[string]any    `json:"depends,omitempty"`
+	Payloads              []Payload         `json:"payloads"`
+	Size                  int64             `json:"size"`
+	SigningKeyFingerprint string            `json:"signingKeyFingerprint,omitempty"`
+}
+
+type Payload struct {
+	Index          int               `json:"index"`
+	Type           string            `json:"type"`
+	Provides       map[string]string `json:"provides,omitempty"`
+	Depends        map[string]any    `json:"depends,omitempty"`
+	ClearsProvides []string          `json:"clearsProvides,omitempty"`
+	Files          []File            `json:"files"`
+	// Size is the size of the payload files, ArchiveSize the size of the
+	// possibly compressed data archive holding them.
+	Size        int64 `json:"size"`
+	ArchiveSize int64 `json:"archiveSize"`
+}
+
+type File struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// headerInfo is the header-info file of version 3 artifacts, with the
+// fields of version 2 artifacts.
+type headerInfo struct {
+	Payloads []struct {
+		Type string `json:"type"`
+	} `json:"payloads"`
+	ArtifactProvides map[string]string `json:"artifact_provides"`
+	ArtifactDepends  map[string]any    `json:"artifact_depends"`
+
+	Updates []struct {
+		Type string `json:"type"`
+	} `json:"updates"`
+	ArtifactName          string   `json:"artifact_name"`
+	DeviceTypesCompatible []string `json:"device_types_compatible"`
+}
+
+type typeInfo struct {
+	Type                   string            `json:"type"`
+	ArtifactProvides       map[string]string `json:"artifact_provides"`
+	ArtifactDepends        map[string]any    `json:"artifact_depends"`
+	ClearsArtifactProvides []string          `json:"clears_artifact_provides"`
+}
+
+func (m *Metadata) applyHeaderInfo(version int, data []byte) error {
+	var info headerInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return err
+	}
+
+	if version < 3 {
+		m.ArtifactName = info.ArtifactName
+		m.DeviceTypesCompatible = info.DeviceTypesCompatible
+		for i, update := range info.Updates {
+			m.Payloads = append(m.Payloads, Payload{Index: i, Type: update.Type, Files: []File{}})
+		}
+		return nil
+	}
+
+	m.ArtifactName = info.ArtifactProvides["artifact_name"]
+	m.ArtifactGroup = info.ArtifactProvides["artifact_group"]
+	m.Provides = info.ArtifactProvides
+	m.Depends = info.ArtifactDepends
+	m.DeviceTypesCompatible = stringList(info.ArtifactDepends["device_type"])
+	for i, payload := range info.Payloads {
+		m.Payloads = append(m.Payloads, Payload{Index: i, Type: payload.Type, Files: []File{}})
+	}
+	return nil
+}
+
+// applyTypeInfo reads headers/NNNN/type-info into the payload NNNN.
+func (m *Metadata) applyTypeInfo(name string, data []byte) error {
+	index, err := payloadIndex(name)
+	if err != nil {
+		return err
+	}
+	if index >= len(m.Payloads) {
+		return fmt.Errorf("%s has no payload in header-info", name)
+	}
+
+	var info typeInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	payload := &m.Payloads[index]
+	if info.Type != "" {
+		payload.Type = info.Type
+	}
+	payload.Provides = info.ArtifactProvides
+	payload.Depends = info.ArtifactDepends
+	payload.ClearsProvides = info.ClearsArtifactProvides
+	return nil
+}
+
+// payloadIndex returns NNNN of headers/NNNN/<file>.
+func payloadIndex(name string) (int, error) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 3 || parts[0] != "headers" {
+		return 0, fmt.Errorf("unexpected header entry %q", name)
+	}
+	index, err := strconv.Atoi(parts[1])
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("unexpected header entry %q", name)
+	}
+	return index, nil
+}
+
+// stringList accepts the string and list of strings forms of depends.
+func stringList(value any) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package menderartifact
+
+import (
+	"archive/tar"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// SigningError reports an artifact that could not be signed.
+type SigningError struct {
+	Err error
+}
+
+func (e *SigningError) Error() string {
+	return fmt.Sprintf("sign artifact: %v", e.Err)
+}
+
+func (e *SigningError) Unwrap() error {
+	return e.Err
+}
+
+// LoadPrivateKey reads the PEM encoded RSA or ECDSA private key of the file
+// path, in PKCS #8, PKCS #1 or SEC 1 form.
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM encoded private key found", path)
+		}
+
+		var key any
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case *ecdsa.PrivateKey:
+			return key, nil
+		}
+		return nil, fmt.Errorf("%s: unsupported key type %T, only RSA and ECDSA keys are supported", path, key)
+	}
+}
+
+// copySigned copies the artifact read from src to dst with its manifest.sig
+// replaced by a signature of opts.Signer, once the original signature passed
+// the other options. The signed artifact is validated as Copy does, verifying
+// the new signature with the public key of the signer.
+func copySigned(dst io.Writer, src io.Reader, opts Options) (*Metadata, error) {
+	key, err := newPublicKey(opts.Signer.Public())
+	if err != nil {
+		return nil, &SigningError{Err: err}
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(rewrite(writer, src, opts))
+	}()
+	metadata, err := Copy(dst, reader, Options{
+		VerifySignature:  true,
+		RequireSignature: true,
+		PublicKeys:       []PublicKey{key},
+	})
+	// Stops the rewrite when the copy failed before the end of the artifact.
+	reader.CloseWithError(io.ErrClosedPipe)
+	return metadata, err
+}
+
+// rewrite copies the entries of the outer archive of the artifact read from
+// src to dst, replacing any manifest.sig with a signature of the manifest
+// placed right after it. The original signature is verified as opts requires
+// first, so that artifacts are never signed when they would be rejected
+// unsigned. Errors reading src are returned as they are.
+func rewrite(dst io.Writer, src io.Reader, opts Options) error {
+	in := &errReader{r: src}
+	tr := tar.NewReader(in)
+	tw := tar.NewWriter(dst)
+	formatError := func(section string, err error) error {
+		if in.err != nil {
+			return in.err
+		}
+		return &FormatError{Section: section, Err: err}
+	}
+
+	section := SectionVersion
+	var pending *tar.Header
+	for {
+		hdr := pending
+		pending = nil
+		if hdr == nil {
+			var err error
+			hdr, err = tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return formatError(section, err)
+			}
+		}
+
+		switch {
+		case hdr.Name == "version":
+			section = SectionManifest
+		case hdr.Name == "manifest":
+			section = SectionHeader
+		case hdr.Name == "manifest.sig":
+			continue
+		case strings.HasPrefix(hdr.Name, "data/"):
+			section = SectionData
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Name != "manifest" {
+			if _, err := io.Copy(tw, tr); err != nil {
+				return formatError(section, err)
+			}
+			continue
+		}
+
+		manifest, err := readMetadata(tr, SectionManifest)
+		if err != nil {
+			if in.err != nil {
+				return in.err
+			}
+			return err
+		}
+		if _, err := tw.Write(manifest); err != nil {
+			return err
+		}
+
+		// The entry after the manifest is its original signature, if any.
+		next, err := tr.Next()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return formatError(SectionHeader, err)
+		}
+		if err == nil && next.Name == "manifest.sig" {
+			original, err := readMetadata(tr, SectionSignature)
+			if err != nil {
+				if in.err != nil {
+					return in.err
+				}
+				return err
+			}
+			if opts.VerifySignature {
+				if _, err := verifySignature(manifest, original, opts.PublicKeys); err != nil {
+					return err
+				}
+			}
+		} else {
+			if opts.VerifySignature && opts.RequireSignature {
+				return &SignatureError{Err: ErrUnsigned}
+			}
+			pending = next
+		}
+
+		signature, err := signManifest(manifest, opts.Signer)
+		if err != nil {
+			return &SigningError{Err: err}
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:     "manifest.sig",
+			Typeflag: tar.TypeReg,
+			Mode:     hdr.Mode,
+			Size:     int64(len(signature)),
+			ModTime:  hdr.ModTime,
+			Format:   hdr.Format,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := tw.Write(signature); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// signManifest signs manifest the way mender-artifact does and the way
+// PublicKey.verify checks it, base64 encoded.
+func signManifest(manifest []byte, signer crypto.Signer) ([]byte, error) {
+	digest := sha256.Sum256(manifest)
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := signer.Public().(type) {
+	case *rsa.PublicKey:
+	case *ecdsa.PublicKey:
+		// crypto.Signer returns ASN.1 ECDSA signatures, mender-artifact uses
+		// the concatenated r and s values.
+		var values struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(signature, &values); err != nil {
+			return nil, fmt.Errorf("parse ECDSA signature: %w", err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		values.R.FillBytes(signature[:size])
+		values.S.FillBytes(signature[size:])
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(signature)))
+	base64.StdEncoding.Encode(encoded, signature)
+	return encoded, nil
+}
@@ -0,0 +1,95 @@
+package menderartifact
+
+import (
+	"bytes"
+	"crypto"
+	"testing"
+)
+
+func TestCopySigned(t *testing.T) {
+	rsaKey, ecdsaKey := generateKeys(t)
+	buildKey, otherKey := generateKeys(t)
+	artifact := testArtifact{version: 3, ext: ".gz", payloads: []string{"rootfs", "app"}}
+	require := Options{VerifySignature: true, RequireSignature: true, PublicKeys: publicKeys(t, buildKey)}
+
+	tests := []struct {
+		name    string
+		signer  crypto.Signer
+		entries func(t *testing.T) []entry
+		opts    Options
+		want    string
+	}{
+		{name: "rsa unsigned", signer: rsaKey, entries: artifact.entries},
+		{name: "ecdsa unsigned", signer: ecdsaKey, entries: artifact.entries},
+		{
+			name:    "v2 unsigned",
+			signer:  rsaKey,
+			entries: testArtifact{version: 2, ext: ".xz", payloads: []string{"rootfs"}}.entries,
+		},
+		{
+			name:    "resigned",
+			signer:  ecdsaKey,
+			entries: func(t *testing.T) []entry { return signed(t, artifact, otherKey) },
+		},
+		{
+			name:    "trusted original",
+			signer:  rsaKey,
+			entries: func(t *testing.T) []entry { return signed(t, artifact, buildKey) },
+			opts:    require,
+		},
+		{
+			name:    "untrusted original",
+			signer:  rsaKey,
+			entries: func(t *testing.T) []entry { return signed(t, artifact, otherKey) },
+			opts:    require,
+			want:    "signature",
+		},
+		{
+			name:    "unsigned original required",
+			signer:  rsaKey,
+			entries: artifact.entries,
+			opts:    require,
+			want:    "signature",
+		},
+		{
+			name:   "corrupted payload",
+			signer: ecdsaKey,
+			entries: func(t *testing.T) []entry {
+				entries := artifact.entries(t)
+				entries[4].data = compress(t, ".gz", tarArchive(t, entry{name: "rootfs.ext4", data: []byte("tampered")}))
+				return entries
+			},
+			want: "checksum",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Signer = tt.signer
+			var dst bytes.Buffer
+			metadata, err := Copy(&dst, bytes.NewReader(tarArchive(t, tt.entries(t)...)), opts)
+			if kind := errorKind(err); kind != tt.want {
+				t.Fatalf("Copy() error = %v, want %s error", err, or(tt.want, "no"))
+			}
+			if err != nil {
+				return
+			}
+
+			signerKeys := publicKeys(t, tt.signer)
+			if metadata.SigningKeyFingerprint != signerKeys[0].Fingerprint {
+				t.Errorf("SigningKeyFingerprint = %q, want the signer's %q", metadata.SigningKeyFingerprint, signerKeys[0].Fingerprint)
+			}
+
+			// The signed artifact verifies with the signer's key only.
+			verify := Options{VerifySignature: true, RequireSignature: true, PublicKeys: signerKeys}
+			if _, err := Copy(&bytes.Buffer{}, bytes.NewReader(dst.Bytes()), verify); err != nil {
+				t.Errorf("verifying the signed artifact: %v", err)
+			}
+			verify.PublicKeys = publicKeys(t, otherKey)
+			if _, err := Copy(&bytes.Buffer{}, bytes.NewReader(dst.Bytes()), verify); errorKind(err) != "signature" {
+				t.Errorf("verifying the signed artifact with another key: error = %v, want signature error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package menderartifact
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// ErrUnsigned is reported when a signature is required and the artifact has
+// no manifest.sig.
+var ErrUnsigned = errors.New("artifact is not signed")
+
+// SignatureError reports an artifact whose signature could not be verified.
+type SignatureError struct {
+	Err error
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("invalid artifact signature: %v", e.Err)
+}
+
+func (e *SignatureError) Unwrap() error {
+	return e.Err
+}
+
+// PublicKey is an RSA or ECDSA key artifacts may be signed with. Its
+// fingerprint is the hex encoded SHA-256 checksum of its PKIX encoding.
+type PublicKey struct {
+	key         crypto.PublicKey
+	Fingerprint string
+}
+
+// LoadPublicKeys reads the PEM encoded public keys of the file path.
+func LoadPublicKeys(path string) ([]PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := ParsePublicKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// ParsePublicKeys parses PEM encoded PKIX ("PUBLIC KEY") and PKCS #1 ("RSA
+// PUBLIC KEY") public keys. Other PEM blocks are ignored.
+func ParsePublicKeys(data []byte) ([]PublicKey, error) {
+	var keys []PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var key any
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		publicKey, err := newPublicKey(key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, publicKey)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no PEM encoded public key found")
+	}
+	return keys, nil
+}
+
+func newPublicKey(key crypto.PublicKey) (PublicKey, error) {
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return PublicKey{}, fmt.Errorf("unsupported key type %T, only RSA and ECDSA keys are supported", key)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return PublicKey{}, err
+	}
+	sum := sha256.Sum256(der)
+	return PublicKey{key: key, Fingerprint: hex.EncodeToString(sum[:])}, nil
+}
+
+// verify checks the base64 encoded signature of message the way mender-artifact
+// signs manifests: RSA PKCS #1 v1.5 or ECDSA over the SHA-256 digest. ECDSA
+// signatures are the concatenated r and s values; ASN.1 signatures are
+// accepted as well.
+func (k PublicKey) verify(message, encoded []byte) error {
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+	digest := sha256.Sum256(message)
+
+	switch key := k.key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(key, digest[:], r, s) {
+				return nil
+			}
+		} else if ecdsa.VerifyASN1(key, digest[:], signature) {
+			return nil
+		}
+		return errors.New("ecdsa: verification error")
+	}
+	return fmt.Errorf("unsupported key type %T", k.key)
+}
+
+// verifySignature returns the key among keys that signed manifest.
+func verifySignature(manifest, signature []byte, keys []PublicKey) (*PublicKey, error) {
+	if len(keys) == 0 {
+		return nil, &SignatureError{Err: errors.New("no public key is configured to verify it")}
+	}
+	for i := range keys {
+		if keys[i].verify(manifest, signature) == nil {
+			return &keys[i], nil
+		}
+	}
+	return nil, &SignatureError{Err: errors.New("manifest.sig does not match any trusted key")}
+}
@@ -0,0 +1,182 @@
+package menderartifact
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"testing"
+)
+
+func generateKeys(t *testing.T) (*rsa.PrivateKey, *ecdsa.PrivateKey) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsaKey, ecdsaKey
+}
+
+func publicKeys(t *testing.T, keys ...crypto.Signer) []PublicKey {
+	t.Helper()
+	var data []byte
+	for _, key := range keys {
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})...)
+	}
+	parsed, err := ParsePublicKeys(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+// mendersign signs manifest the way mender-artifact does: RSA PKCS #1 v1.5 or
+// ECDSA with the concatenated r and s values, over the SHA-256 digest and
+// base64 encoded.
+func mendersign(t *testing.T, key crypto.Signer, manifest []byte) []byte {
+	t.Helper()
+	digest := sha256.Sum256(manifest)
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return []byte(base64.StdEncoding.EncodeToString(signature))
+}
+
+// signed returns the entries of artifact with a manifest.sig made by key.
+func signed(t *testing.T, artifact testArtifact, key crypto.Signer) []entry {
+	t.Helper()
+	entries := artifact.entries(t)
+	signature := mendersign(t, key, find(entries, "manifest"))
+	return insertAfter(entries, "manifest", entry{name: "manifest.sig", data: signature})
+}
+
+func TestCopySignature(t *testing.T) {
+	rsaKey, ecdsaKey := generateKeys(t)
+	_, otherKey := generateKeys(t)
+	trusted := publicKeys(t, rsaKey, ecdsaKey)
+	verify := Options{VerifySignature: true, PublicKeys: trusted}
+	require := Options{VerifySignature: true, RequireSignature: true, PublicKeys: trusted}
+	artifact := testArtifact{version: 3, ext: ".gz", payloads: []string{"rootfs"}}
+
+	tests := []struct {
+		name        string
+		entries     func(t *testing.T) []entry
+		opts        Options
+		want        string
+		fingerprint string
+	}{
+		{
+			name:        "rsa",
+			entries:     func(t *testing.T) []entry { return signed(t, artifact, rsaKey) },
+			opts:        require,
+			fingerprint: trusted[0].Fingerprint,
+		},
+		{
+			name:        "ecdsa",
+			entries:     func(t *testing.T) []entry { return signed(t, artifact, ecdsaKey) },
+			opts:        require,
+			fingerprint: trusted[1].Fingerprint,
+		},
+		{
+			name: "v2 rsa",
+			entries: func(t *testing.T) []entry {
+				return signed(t, testArtifact{version: 2, ext: ".gz", payloads: []string{"rootfs"}}, rsaKey)
+			},
+			opts:        require,
+			fingerprint: trusted[0].Fingerprint,
+		},
+		{
+			name:    "unsigned with verify",
+			entries: artifact.entries,
+			opts:    verify,
+		},
+		{
+			name:    "unsigned with require",
+			entries: artifact.entries,
+			opts:    require,
+			want:    "signature",
+		},
+		{
+			name:    "untrusted key",
+			entries: func(t *testing.T) []entry { return signed(t, artifact, otherKey) },
+			opts:    verify,
+			want:    "signature",
+		},
+		{
+			name:    "untrusted key ignored",
+			entries: func(t *testing.T) []entry { return signed(t, artifact, otherKey) },
+		},
+		{
+			name: "garbage signature",
+			entries: func(t *testing.T) []entry {
+				return insertAfter(artifact.entries(t), "manifest", entry{name: "manifest.sig", data: []byte("!!")})
+			},
+			opts: verify,
+			want: "signature",
+		},
+		{
+			name: "tampered manifest",
+			entries: func(t *testing.T) []entry {
+				entries := signed(t, artifact, rsaKey)
+				entries[1].data = append(entries[1].data, fmt.Sprintf("%s  data/0000/extra\n", checksum(nil))...)
+				return entries
+			},
+			opts: verify,
+			want: "signature",
+		},
+		{
+			name: "tampered manifest-augment",
+			entries: func(t *testing.T) []entry {
+				entries := signed(t, artifact, ecdsaKey)
+				entries[4].data = compress(t, ".gz", tarArchive(t, entry{name: "rootfs.ext4", data: []byte("tampered")}))
+				augment := fmt.Sprintf("%s  data/0000/rootfs.ext4\n", checksum([]byte("tampered")))
+				return insertAfter(entries, "manifest.sig", entry{name: "manifest-augment", data: []byte(augment)})
+			},
+			opts: require,
+			want: "format",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata, err := Copy(&bytes.Buffer{}, bytes.NewReader(tarArchive(t, tt.entries(t)...)), tt.opts)
+			if kind := errorKind(err); kind != tt.want {
+				t.Fatalf("Copy() error = %v, want %s error", err, or(tt.want, "no"))
+			}
+			if err != nil {
+				return
+			}
+			if metadata.SigningKeyFingerprint != tt.fingerprint {
+				t.Errorf("SigningKeyFingerprint = %q, want %q", metadata.SigningKeyFingerprint, tt.fingerprint)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var (
+	WorkersActive         = expvar.NewInt("workers_active")
+	WorkersQueued         = expvar.NewInt("workers_queued")
+	WorkersActiveByDomain = expvar.NewMap("workers_active_by_domain")
+	OutboxPending         = expvar.NewInt("outbox_pending")
+)
+
+// Serve exposes the metrics on addr in the Prometheus text format at /metrics
+// and as JSON at /debug/vars.
+func Serve(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/metrics", writePrometheus)
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+	return server
+}
+
+func writePrometheus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	expvar.Do(func(kv expvar.KeyValue) {
+		name := "menderartifactsconsumer_" + kv.Key
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			fmt.Fprintf(w, "%s %d\n", name, v.Value())
+		case *expvar.Float:
+			fmt.Fprintf(w, "%s %g\n", name, v.Value())
+		case *expvar.Map:
+			var lines []string
+			v.Do(func(entry expvar.KeyValue) {
+				lines = append(lines, fmt.Sprintf("%s{key=%q} %s", name, entry.Key, entry.Value.String()))
+			})
+			sort.Strings(lines)
+			if len(lines) > 0 {
+				fmt.Fprintln(w, strings.Join(lines, "\n"))
+			}
+		}
+	})
+}
@@ -0,0 +1,207 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/menderartifactsconsumer/internal/artifact"
+	"github.com/menderartifactsconsumer/internal/config"
+	"github.com/menderartifactsconsumer/internal/event"
+	"github.com/menderartifactsconsumer/internal/failure"
+	"github.com/menderartifactsconsumer/internal/idempotency"
+	"github.com/menderartifactsconsumer/internal/publisher"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const UploadBatchSubject = "artifact.uploadBatch.>"
+
+// uploadBatchHandler uploads the items of a batch, at most concurrency at a
+// time, and publishes a batch.completed event with the result of every item.
+// Each item takes a slot of limiter for its domain, so batches share the
+// worker limits with single uploads. Item failures do not fail the message:
+// resubmitting the batch retries the failed items while completed ones are
+// deduplicated by their request id.
+func uploadBatchHandler(pub *publisher.Publisher, uploader *artifact.Uploader, store *idempotency.Store, limiter *Limiter, cfg *config.Config) HandlerFunc {
+	return func(ctx context.Context, msg jetstream.Msg) error {
+		batch, _ := Payload[artifact.UploadBatchRequest](ctx)
+		batch.AssignRequestIds()
+		if err := validateBatch(batch, cfg.Batch.MaxItems); err != nil {
+			return err
+		}
+
+		concurrency := cfg.Batch.Concurrency
+		if batch.Concurrency > 0 && batch.Concurrency < concurrency {
+			concurrency = batch.Concurrency
+		}
+		policy := cfg.Batch.FailurePolicy
+		if batch.FailurePolicy != "" {
+			policy = batch.FailurePolicy
+		}
+		log.Printf("Received batch %s with %d items, concurrency %d, failure policy %s", batch.BatchId, len(batch.Items), concurrency, policy)
+
+		// Items may wait for slots longer than the ack wait.
+		stopHeartbeat := artifact.KeepAlive(ctx, msg, cfg.Consumer.HeartbeatInterval())
+		defer stopHeartbeat()
+
+		result := artifact.UploadBatchResult{BatchId: batch.BatchId, Items: make([]artifact.BatchItemResult, len(batch.Items))}
+		for i := range batch.Items {
+			result.Items[i] = itemResult(&batch.Items[i], artifact.ItemSkipped)
+		}
+
+		// Items answer on their own subjects only, the reply subject of the
+		// message is for the batch result.
+		itemCtx := publisher.WithReply(ctx, "")
+		var (
+			stopped atomic.Bool
+			wg      sync.WaitGroup
+		)
+		slots := make(chan struct{}, concurrency)
+	items:
+		for i := range batch.Items {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				break items
+			}
+			if stopped.Load() {
+				<-slots
+				break
+			}
+
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer func() { <-slots }()
+
+				release, err := limiter.Acquire(ctx, batch.Items[i].AuthRequest.Domain)
+				if err != nil {
+					return
+				}
+				defer release()
+				if stopped.Load() {
+					return
+				}
+
+				item := uploadBatchItem(itemCtx, pub, uploader, store, msg, &batch.Items[i], cfg)
+				result.Items[i] = item
+				if item.Status == artifact.ItemFailed && policy == artifact.FailurePolicyStop {
+					stopped.Store(true)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		// Interrupted batches, e.g. on shutdown, are redelivered to upload the
+		// items that did not run.
+		if err := ctx.Err(); err != nil {
+			return failure.Transient(failure.CodeInternal, fmt.Errorf("batch %s interrupted: %w", batch.BatchId, err))
+		}
+
+		result.Aggregate()
+		log.Printf("Batch %s %s: %d succeeded, %d failed, %d skipped, %d in progress", batch.BatchId, result.Status, result.Succeeded, result.Failed, result.Skipped, result.InProgress)
+
+		status := event.StatusCompleted
+		if result.Status != artifact.BatchCompleted {
+			status = event.StatusFailed
+		}
+		completed := event.New(batch.BatchId, event.TypeBatchCompleted, status).WithData(result)
+		if err := pub.Respond(ctx, completed.Msg("artifact.uploadBatchResponse."+batch.BatchId, 0)); err != nil {
+			log.Printf("Failed to publish result of batch %s: %v", batch.BatchId, err)
+			return failure.Transient(failure.CodeInternal, err)
+		}
+		return nil
+	}
+}
+
+func validateBatch(batch *artifact.UploadBatchRequest, maxItems int) error {
+	var problem string
+	switch {
+	case batch.BatchId == "":
+		problem = "batchId is required"
+	case len(batch.Items) == 0:
+		problem = "items must not be empty"
+	case len(batch.Items) > maxItems:
+		problem = fmt.Sprintf("batch has %d items, at most %d are allowed", len(batch.Items), maxItems)
+	case batch.FailurePolicy != "" && batch.FailurePolicy != artifact.FailurePolicyContinue && batch.FailurePolicy != artifact.FailurePolicyStop:
+		problem = fmt.Sprintf("failurePolicy %q must be continue or stop", batch.FailurePolicy)
+	}
+	if problem != "" {
+		return failure.Permanent(failure.CodeInvalidRequest, fmt.Errorf("%w: %s", ErrInvalidPayload, problem))
+	}
+
+	seen := make(map[string]bool, len(batch.Items))
+	for i := range batch.Items {
+		item := &batch.Items[i]
+		if err := validateUploadRequest(item); err != nil {
+			return fmt.Errorf("items[%d]: %w", i, err)
+		}
+		requestId := item.AuthRequest.RequestId
+		if seen[requestId] {
+			return failure.Permanent(failure.CodeInvalidRequest, fmt.Errorf("%w: duplicate requestId %s", ErrInvalidPayload, requestId))
+		}
+		seen[requestId] = true
+	}
+	return nil
+}
+
+// uploadBatchItem uploads one item within the handler timeout. Failed items
+// get an upload.failed event on their own subject, unless the whole batch was
+// interrupted and will be redelivered.
+func uploadBatchItem(ctx context.Context, pub *publisher.Publisher, uploader *artifact.Uploader, store *idempotency.Store, msg jetstream.Msg, item *artifact.UploadArtifactRequest, cfg *config.Config) artifact.BatchItemResult {
+	itemCtx, cancel := context.WithTimeout(ctx, cfg.HandlerTimeout)
+	defer cancel()
+
+	response, err := processUpload(itemCtx, pub, uploader, store, msg, item)
+	switch {
+	case err == nil:
+		result := itemResult(item, artifact.ItemCompleted)
+		if response != nil {
+			result.MenderStatusCode, _ = strconv.Atoi(response.Header.Get(event.StatusCodeHeader))
+			var completed struct {
+				Data artifact.UploadArtifactResult `json:"data"`
+			}
+			if json.Unmarshal(response.Data, &completed) == nil {
+				result.Artifact = completed.Data.Artifact
+			}
+		}
+		return result
+	case errors.Is(err, artifact.ErrUploadCancelled):
+		return itemResult(item, artifact.ItemCancelled)
+	case errors.Is(err, idempotency.ErrInProgress):
+		// Another message holds the request and reports its outcome.
+		result := itemResult(item, artifact.ItemInProgress)
+		result.Message = failure.Message(err)
+		return result
+	}
+
+	result := itemResult(item, artifact.ItemFailed)
+	result.MenderStatusCode = failure.StatusCode(err)
+	result.ErrorCode = string(failure.CodeOf(err))
+	result.Message = failure.Message(err)
+
+	if ctx.Err() == nil {
+		requestId := item.AuthRequest.RequestId
+		details := FailureDetails{UpstreamStatusCode: result.MenderStatusCode, Final: true}
+		failed := failureEvent(requestId, event.TypeUploadFailed, err, details)
+		if err := pub.Publish(ctx, failed.Msg("artifact.uploadArtifactTargetApplicationResponse."+requestId, result.MenderStatusCode)); err != nil {
+			log.Printf("Failed to publish failure of %s: %v", requestId, err)
+		}
+	}
+	return result
+}
+
+func itemResult(item *artifact.UploadArtifactRequest, status artifact.ItemStatus) artifact.BatchItemResult {
+	return artifact.BatchItemResult{
+		RequestId:     item.AuthRequest.RequestId,
+		Domain:        item.AuthRequest.Domain,
+		ContainerName: item.BlobMetadata.ContainerName,
+		BlobName:      item.BlobMetadata.BlobName,
+		Status:        status,
+	}
+}
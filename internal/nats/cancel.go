@@ -0,0 +1,85 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/menderartifactsconsumer/internal/artifact"
+	"github.com/menderartifactsconsumer/internal/event"
+	"github.com/menderartifactsconsumer/internal/failure"
+	"github.com/menderartifactsconsumer/internal/idempotency"
+	"github.com/menderartifactsconsumer/internal/jobs"
+	nats "github.com/nats-io/nats.go"
+)
+
+// CancelUploadSubject is subscribed to with core NATS rather than through the
+// stream so that a cancellation is not queued behind uploads and reaches the
+// instance running the upload.
+const CancelUploadSubject = "artifact.cancelUpload.*"
+
+// CancelUploadResult is the data of the cancel.result event answering a
+// cancellation.
+type CancelUploadResult struct {
+	Cancelled bool              `json:"cancelled"`
+	State     idempotency.State `json:"state,omitempty"`
+}
+
+// SubscribeCancelUpload cancels the upload of a request when it runs on this
+// instance. Otherwise the request is recorded as cancelled unless it completed,
+// so that it is not uploaded once a worker picks it up. Uploads running on
+// another instance are left to that instance, which answers the request.
+func SubscribeCancelUpload(nc *nats.Conn, uploader *artifact.Uploader, store *idempotency.Store, jobStore *jobs.Store) (*nats.Subscription, error) {
+	sub, err := nc.Subscribe(CancelUploadSubject, func(msg *nats.Msg) {
+		requestId := msg.Subject[strings.LastIndex(msg.Subject, ".")+1:]
+		result, ok := cancelUpload(uploader, store, jobStore, requestId)
+		if !ok || msg.Reply == "" {
+			return
+		}
+		if err := msg.RespondMsg(result.Msg(msg.Reply, 0)); err != nil {
+			log.Printf("Failed to respond to cancel request: %v", err)
+		}
+	})
+	if err != nil {
+		log.Printf("Failed to subscribe to %s: %v", CancelUploadSubject, err)
+		return nil, err
+	}
+	return sub, nil
+}
+
+// cancelUpload cancels the upload of requestId and returns the cancel.result
+// event answering it. ok is false when the upload is running on another
+// instance.
+func cancelUpload(uploader *artifact.Uploader, store *idempotency.Store, jobStore *jobs.Store, requestId string) (result event.Event, ok bool) {
+	cancelled := event.New(requestId, event.TypeCancelResult, event.StatusCancelled).
+		WithData(CancelUploadResult{Cancelled: true, State: idempotency.StateCancelled})
+	if uploader.Cancel(requestId) {
+		return cancelled, true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), syncRequestTimeout)
+	defer cancel()
+
+	state, err := store.CancelPending(ctx, requestId)
+	if err != nil {
+		log.Printf("Failed to cancel request %s: %v", requestId, err)
+		failed := event.New(requestId, event.TypeCancelResult, event.StatusFailed).WithMessage("failed to cancel the upload")
+		failed.ErrorCode = string(failure.CodeInternal)
+		return failed, true
+	}
+	switch state {
+	case idempotency.StateCancelled:
+		log.Printf("Cancelled pending upload %s", requestId)
+		if _, err := jobStore.Cancel(ctx, requestId); err != nil {
+			log.Printf("Failed to record cancelled state of job %s: %v", requestId, err)
+		}
+		return cancelled, true
+	case idempotency.StateProcessing:
+		// The upload may have been claimed here after the first check.
+		return cancelled, uploader.Cancel(requestId)
+	}
+	return event.New(requestId, event.TypeCancelResult, event.StatusFailed).
+		WithMessage(fmt.Sprintf("upload is already %s", state)).
+		WithData(CancelUploadResult{State: state}), true
+}
@@ -0,0 +1,149 @@
+package nats
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/menderartifactsconsumer/internal/config"
+	"github.com/menderartifactsconsumer/internal/jobs"
+	"github.com/menderartifactsconsumer/internal/publisher"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	cancelWaitTimeout = 10 * time.Second
+
+	// queuedBacklog is how many messages may wait for their jobs to be
+	// recorded as queued before records are dropped.
+	queuedBacklog = 1024
+)
+
+// Consumer feeds messages from a JetStream consumer through a worker pool into
+// a Router, so that Shutdown can wait for the handlers in flight.
+type Consumer struct {
+	publisher *publisher.Publisher
+	consumer  jetstream.Consumer
+	router    *Router
+	jobs      *jobs.Store
+	cfg       *config.Config
+	pool      *Pool
+	queued    chan jetstream.Msg
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	stopping bool
+	cctx     jetstream.ConsumeContext
+}
+
+func NewConsumer(pub *publisher.Publisher, consumer jetstream.Consumer, router *Router, limiter *Limiter, jobStore *jobs.Store, cfg *config.Config) *Consumer {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Consumer{
+		publisher: pub,
+		consumer:  consumer,
+		router:    router,
+		jobs:      jobStore,
+		cfg:       cfg,
+		queued:    make(chan jetstream.Msg, queuedBacklog),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	c.pool = NewPool(limiter, cfg.Consumer.HeartbeatInterval(), DomainKey, c.handle)
+	return c
+}
+
+func (c *Consumer) Start() error {
+	c.pool.Start()
+	go c.recordQueued()
+
+	cctx, err := c.consumer.Consume(c.submit)
+	if err != nil {
+		log.Printf("Failed to start consuming: %v", err)
+		c.pool.Close()
+		return err
+	}
+
+	c.mu.Lock()
+	c.cctx = cctx
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Consumer) submit(msg jetstream.Msg) {
+	c.mu.Lock()
+	stopping := c.stopping
+	c.mu.Unlock()
+
+	if stopping {
+		msg.Nak()
+		return
+	}
+
+	if !c.pool.Submit(msg) {
+		msg.Nak()
+		return
+	}
+	// The Consume callback must not wait for the job store.
+	select {
+	case c.queued <- msg:
+	default:
+		log.Printf("Job record backlog full, not recording %s as queued", msg.Subject())
+	}
+}
+
+// recordQueued records the jobs of submitted messages as queued until the
+// consumer is shut down.
+func (c *Consumer) recordQueued() {
+	for {
+		select {
+		case msg := <-c.queued:
+			recordQueued(c.ctx, c.jobs, msg)
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Consumer) handle(msg jetstream.Msg) {
+	err := c.router.Dispatch(c.ctx, msg)
+	c.settle(msg, err)
+}
+
+// Shutdown stops pulling new messages, naks the queued ones and waits for
+// in-flight handlers to finish. When ctx expires first, the handlers'
+// contexts are cancelled and ctx's error is returned once they have returned.
+func (c *Consumer) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.stopping = true
+	if c.cctx != nil {
+		c.cctx.Stop()
+	}
+	c.mu.Unlock()
+
+	c.pool.Close()
+
+	done := make(chan struct{})
+	go func() {
+		c.pool.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		c.cancel()
+		return nil
+	case <-ctx.Done():
+	}
+
+	log.Print("Grace period expired, cancelling in-flight handlers")
+	c.cancel()
+	select {
+	case <-done:
+	case <-time.After(cancelWaitTimeout):
+		log.Print("In-flight handlers did not return after cancellation")
+	}
+	return ctx.Err()
+}
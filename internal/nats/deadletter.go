@@ -0,0 +1,162 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/menderartifactsconsumer/internal/config"
+	"github.com/menderartifactsconsumer/internal/failure"
+	"github.com/menderartifactsconsumer/internal/publisher"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	DeadLetterReasonHeader        = "Dlq-Reason"
+	DeadLetterOriginalSubject     = "Dlq-Original-Subject"
+	DeadLetterDeliveryCountHeader = "Dlq-Delivery-Count"
+	DeadLetterStreamHeader        = "Dlq-Stream"
+	DeadLetterSequenceHeader      = "Dlq-Stream-Sequence"
+	DeadLetterReceivedAtHeader    = "Dlq-Received-At"
+	DeadLetterFailedAtHeader      = "Dlq-Failed-At"
+)
+
+// redactedValue replaces the tokens of dead-lettered payloads.
+const redactedValue = "[REDACTED]"
+
+// maxDeliveriesAdvisorySubject is where the server reports the messages of
+// a consumer that reached their max deliveries without being acked.
+const maxDeliveriesAdvisorySubject = "$JS.EVENT.ADVISORY.CONSUMER.MAX_DELIVERIES.%s.%s"
+
+var errMaxDeliveries = errors.New("max deliveries reached without an ack")
+
+// maxDeliveriesAdvisory is the part of the advisory used to find the message.
+type maxDeliveriesAdvisory struct {
+	Stream     string `json:"stream"`
+	Consumer   string `json:"consumer"`
+	StreamSeq  uint64 `json:"stream_seq"`
+	Deliveries uint64 `json:"deliveries"`
+}
+
+// deadLetter republishes msg on <prefix>.<original subject> with headers
+// describing why and when it failed, so that it can be inspected or replayed.
+// The headers in dropHeaders and the tokens of the payload are left out.
+func deadLetter(pub *publisher.Publisher, msg jetstream.Msg, prefix string, dropHeaders []string, reason error) error {
+	meta, _ := msg.Metadata()
+	return publishDeadLetter(pub, msg.Subject(), msg.Headers(), msg.Data(), meta, prefix, dropHeaders, reason)
+}
+
+func publishDeadLetter(pub *publisher.Publisher, subject string, header nats.Header, data []byte, meta *jetstream.MsgMetadata, prefix string, dropHeaders []string, reason error) error {
+	dlqMsg := deadLetterMsg(subject, header, data, meta, prefix, dropHeaders, reason)
+	if err := pub.Publish(context.Background(), dlqMsg); err != nil {
+		log.Printf("Failed to publish message with subject %s to dead-letter subject: %v", subject, err)
+		return err
+	}
+	log.Printf("Moved message with subject %s to %s", subject, dlqMsg.Subject)
+	return nil
+}
+
+func deadLetterMsg(subject string, header nats.Header, data []byte, meta *jetstream.MsgMetadata, prefix string, dropHeaders []string, reason error) *nats.Msg {
+	dlqMsg := nats.NewMsg(prefix + "." + subject)
+	for key, values := range header {
+		for _, value := range values {
+			dlqMsg.Header.Add(key, value)
+		}
+	}
+	for _, key := range dropHeaders {
+		dlqMsg.Header.Del(key)
+	}
+	dlqMsg.Data = redactTokens(data)
+
+	dlqMsg.Header.Set(DeadLetterReasonHeader, failure.Message(reason))
+	dlqMsg.Header.Set(DeadLetterOriginalSubject, subject)
+	dlqMsg.Header.Set(DeadLetterFailedAtHeader, time.Now().UTC().Format(time.RFC3339Nano))
+	if meta != nil {
+		dlqMsg.Header.Set(DeadLetterDeliveryCountHeader, strconv.FormatUint(meta.NumDelivered, 10))
+		dlqMsg.Header.Set(DeadLetterStreamHeader, meta.Stream)
+		dlqMsg.Header.Set(DeadLetterSequenceHeader, strconv.FormatUint(meta.Sequence.Stream, 10))
+		dlqMsg.Header.Set(DeadLetterReceivedAtHeader, meta.Timestamp.UTC().Format(time.RFC3339Nano))
+	}
+	return dlqMsg
+}
+
+// SubscribeMaxDeliveries dead-letters the messages the server stops
+// redelivering without settle having terminated them: deliveries whose ack
+// wait expired, e.g. because the instance handling them died, and last
+// deliveries nakked because their dead letter could not be published. The
+// messages are fetched from the stream, where they are kept. Every instance
+// joins the same queue group so that each advisory is handled once.
+func SubscribeMaxDeliveries(nc *nats.Conn, stream jetstream.Stream, pub *publisher.Publisher, cfg *config.Config) (*nats.Subscription, error) {
+	subject := fmt.Sprintf(maxDeliveriesAdvisorySubject, cfg.Stream.Name, cfg.Consumer.Name)
+	sub, err := nc.QueueSubscribe(subject, cfg.Consumer.Name, func(msg *nats.Msg) {
+		var advisory maxDeliveriesAdvisory
+		if err := json.Unmarshal(msg.Data, &advisory); err != nil {
+			log.Printf("Failed to decode max deliveries advisory: %v", err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), syncRequestTimeout)
+		defer cancel()
+
+		stored, err := stream.GetMsg(ctx, advisory.StreamSeq)
+		if err != nil {
+			log.Printf("Failed to get message %d of stream %s to dead-letter it: %v", advisory.StreamSeq, advisory.Stream, err)
+			return
+		}
+		meta := &jetstream.MsgMetadata{
+			Sequence:     jetstream.SequencePair{Stream: stored.Sequence},
+			NumDelivered: advisory.Deliveries,
+			Stream:       advisory.Stream,
+			Consumer:     advisory.Consumer,
+			Timestamp:    stored.Time,
+		}
+		log.Printf("Message with subject %s reached max deliveries without an ack", stored.Subject)
+		publishDeadLetter(pub, stored.Subject, stored.Header, stored.Data, meta, cfg.DeadLetterSubjectPrefix, []string{cfg.AuthHeader}, errMaxDeliveries)
+	})
+	if err != nil {
+		log.Printf("Failed to subscribe to %s: %v", subject, err)
+		return nil, err
+	}
+	return sub, nil
+}
+
+// redactTokens replaces the value of every "token" field of a JSON payload,
+// such as request_data.token of upload requests and batch items. Payloads
+// that are not JSON objects are returned as they are.
+func redactTokens(data []byte) []byte {
+	var payload map[string]any
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return append([]byte(nil), data...)
+	}
+	redact(payload)
+	redacted, err := json.Marshal(payload)
+	if err != nil {
+		return append([]byte(nil), data...)
+	}
+	return redacted
+}
+
+func redact(value any) {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, field := range v {
+			if strings.EqualFold(key, "token") {
+				if _, ok := field.(string); ok {
+					v[key] = redactedValue
+					continue
+				}
+			}
+			redact(field)
+		}
+	case []any:
+		for _, item := range v {
+			redact(item)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package nats
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func TestRedactTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "upload request",
+			data: `{"request_data": {"requestId": "abc", "token": "secret"}, "Artifact": {"blobName": "app.mender"}}`,
+			want: `{"request_data": {"requestId": "abc", "token": "[REDACTED]"}, "Artifact": {"blobName": "app.mender"}}`,
+		},
+		{
+			name: "batch items",
+			data: `{"batchId": "b", "items": [{"request_data": {"Token": "a"}}, {"request_data": {"token": "b"}}]}`,
+			want: `{"batchId": "b", "items": [{"request_data": {"Token": "[REDACTED]"}}, {"request_data": {"token": "[REDACTED]"}}]}`,
+		},
+		{
+			name: "non-string token",
+			data: `{"token": {"token": "secret"}}`,
+			want: `{"token": {"token": "[REDACTED]"}}`,
+		},
+		{
+			name: "no token",
+			data: `{"requestId": "abc"}`,
+			want: `{"requestId": "abc"}`,
+		},
+		{
+			name: "not json",
+			data: `token=secret`,
+			want: `token=secret`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := redactTokens([]byte(tt.data))
+			if !json.Valid([]byte(tt.want)) {
+				if string(got) != tt.want {
+					t.Errorf("redactTokens() = %s, want %s", got, tt.want)
+				}
+				return
+			}
+			var gotValue, wantValue any
+			if err := json.Unmarshal(got, &gotValue); err != nil {
+				t.Fatalf("redactTokens() = %s: %v", got, err)
+			}
+			json.Unmarshal([]byte(tt.want), &wantValue)
+			if !reflect.DeepEqual(gotValue, wantValue) {
+				t.Errorf("redactTokens() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeadLetterMsg(t *testing.T) {
+	header := nats.Header{}
+	header.Set("Authorization", "Bearer secret")
+	header.Set("Reply-To", "_INBOX.abc")
+	data := []byte(`{"request_data": {"requestId": "abc", "token": "secret"}}`)
+	received := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	meta := &jetstream.MsgMetadata{
+		Sequence:     jetstream.SequencePair{Stream: 42},
+		NumDelivered: 5,
+		Stream:       "ARTIFACTS",
+		Timestamp:    received,
+	}
+
+	msg := deadLetterMsg("artifact.uploadArtifact.abc", header, data, meta, "dlq", []string{"Authorization"}, errors.New("mender responded with status 500"))
+
+	if msg.Subject != "dlq.artifact.uploadArtifact.abc" {
+		t.Errorf("subject = %s, want dlq.artifact.uploadArtifact.abc", msg.Subject)
+	}
+	if _, ok := msg.Header["Authorization"]; ok {
+		t.Error("auth header was not removed")
+	}
+	if header.Get("Authorization") == "" {
+		t.Error("auth header was removed from the original message")
+	}
+	wantHeaders := map[string]string{
+		"Reply-To":                    "_INBOX.abc",
+		DeadLetterReasonHeader:        "mender responded with status 500",
+		DeadLetterOriginalSubject:     "artifact.uploadArtifact.abc",
+		DeadLetterDeliveryCountHeader: "5",
+		DeadLetterStreamHeader:        "ARTIFACTS",
+		DeadLetterSequenceHeader:      "42",
+		DeadLetterReceivedAtHeader:    received.Format(time.RFC3339Nano),
+	}
+	for key, want := range wantHeaders {
+		if got := msg.Header.Get(key); got != want {
+			t.Errorf("header %s = %q, want %q", key, got, want)
+		}
+	}
+	if msg.Header.Get(DeadLetterFailedAtHeader) == "" {
+		t.Errorf("header %s is not set", DeadLetterFailedAtHeader)
+	}
+
+	var payload struct {
+		RequestData struct {
+			RequestId string `json:"requestId"`
+			Token     string `json:"token"`
+		} `json:"request_data"`
+	}
+	if err := json.Unmarshal(msg.Data, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.RequestData.Token != redactedValue || payload.RequestData.RequestId != "abc" {
+		t.Errorf("payload = %s, want the token redacted", msg.Data)
+	}
+}
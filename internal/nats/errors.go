@@ -0,0 +1,87 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/menderartifactsconsumer/internal/event"
+	"github.com/menderartifactsconsumer/internal/failure"
+	"github.com/menderartifactsconsumer/internal/idempotency"
+	"github.com/menderartifactsconsumer/internal/publisher"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ErrorTarget returns the request id of msg and the subject and event type its
+// failures are reported with. ok is false for messages nobody waits on.
+type ErrorTarget func(msg jetstream.Msg) (requestId, subject string, eventType event.Type, ok bool)
+
+// FailureDetails is the data of error events.
+type FailureDetails struct {
+	UpstreamStatusCode int    `json:"upstreamStatusCode,omitempty"`
+	Attempt            uint64 `json:"attempt,omitempty"`
+	Final              bool   `json:"final"`
+}
+
+// ErrorEvents publishes an event for every failed message on the subject
+// returned by target. Failures that end the request use the event type of
+// the target, failures that will be retried are reported as request.retrying.
+func ErrorEvents(pub *publisher.Publisher, target ErrorTarget, maxDeliver int) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg jetstream.Msg) error {
+			err := next(ctx, msg)
+			if err == nil || errors.Is(err, idempotency.ErrInProgress) {
+				return err
+			}
+			requestId, subject, eventType, ok := target(msg)
+			if !ok {
+				return err
+			}
+
+			details := FailureDetails{
+				UpstreamStatusCode: failure.StatusCode(err),
+				Final:              failure.IsPermanent(err) || lastDelivery(msg, maxDeliver),
+			}
+			if meta, metaErr := msg.Metadata(); metaErr == nil {
+				details.Attempt = meta.NumDelivered
+			}
+
+			if !details.Final {
+				eventType = event.TypeRetrying
+			}
+			e := failureEvent(requestId, eventType, err, details)
+
+			// Only final failures answer the requester; a retry would otherwise
+			// end a request-reply before the request does.
+			publish := pub.Publish
+			if details.Final {
+				publish = pub.Respond
+			}
+			if pubErr := publish(ctx, e.Msg(subject, details.UpstreamStatusCode)); pubErr != nil {
+				log.Printf("Failed to publish error event for %s: %v", msg.Subject(), pubErr)
+			}
+			return err
+		}
+	}
+}
+
+// failureEvent builds the event reporting err. request.retrying events are
+// in progress, every other type has failed.
+func failureEvent(requestId string, eventType event.Type, err error, details FailureDetails) event.Event {
+	status := event.StatusFailed
+	if eventType == event.TypeRetrying {
+		status = event.StatusInProgress
+	}
+	e := event.New(requestId, eventType, status).WithMessage(failure.Message(err)).WithData(details)
+	e.ErrorCode = string(failure.CodeOf(err))
+	return e
+}
+
+// lastDelivery reports whether msg will not be redelivered after a failure.
+func lastDelivery(msg jetstream.Msg, maxDeliver int) bool {
+	if maxDeliver <= 0 {
+		return false
+	}
+	meta, err := msg.Metadata()
+	return err == nil && meta.NumDelivered >= uint64(maxDeliver)
+}
@@ -2,46 +2,224 @@ package nats
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
-	"time"
+	"net/url"
+	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	"github.com/menderartifactsconsumer/internal/artifact"
 	"github.com/menderartifactsconsumer/internal/config"
+	"github.com/menderartifactsconsumer/internal/event"
+	"github.com/menderartifactsconsumer/internal/failure"
+	"github.com/menderartifactsconsumer/internal/idempotency"
+	"github.com/menderartifactsconsumer/internal/jobs"
+	"github.com/menderartifactsconsumer/internal/publisher"
+	nats "github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
 )
 
-func handleRequest(js jetstream.JetStream, msg jetstream.Msg, azureServiceClient *azblob.Client, cfg *config.Config) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
-	defer cancel()
+const (
+	UploadArtifactSubject   = "artifact.uploadArtifact.>"
+	GenerateSASTokenSubject = "artifact.GenerateSASToken.>"
+)
 
-	log.Print("Received message with subject " + msg.Subject())
-	switch msg.Subject() {
-	case "artifact.uploadArtifact.>":
-		{
-			_, err := artifact.UploadArtifact(ctx, js, msg, azureServiceClient, cfg)
-			if err != nil {
-				log.Printf("Failed to upload Artifact: %v", err)
-				msg.Ack()
-				return
-			}
-			return
+func NewArtifactRouter(pub *publisher.Publisher, azureServiceClient *azblob.Client, uploader *artifact.Uploader, store *idempotency.Store, limiter *Limiter, cfg *config.Config) *Router {
+	router := NewRouter()
+	router.Use(Reply(), ErrorEvents(pub, errorTarget, cfg.Consumer.MaxDeliver), Recover(), Logging(), Timing())
+	if len(cfg.AuthTokens) > 0 {
+		router.Use(Auth(HeaderTokenAuth(cfg.AuthHeader, cfg.AuthTokens)))
+	}
+
+	// Batches apply the handler timeout to each of their items instead.
+	router.Handle(UploadArtifactSubject, uploadArtifactHandler(pub, uploader, store),
+		Timeout(cfg.HandlerTimeout), DecodeJSON[artifact.UploadArtifactRequest]())
+	router.Handle(UploadBatchSubject, uploadBatchHandler(pub, uploader, store, limiter, cfg),
+		DecodeJSON[artifact.UploadBatchRequest]())
+	router.Handle(GenerateSASTokenSubject, generateSASTokenHandler(pub, azureServiceClient, cfg),
+		Timeout(cfg.HandlerTimeout), DecodeJSON[artifact.GenerateSASTokenRequest]())
+	router.Fallback(ErrorReplyFallback(pub, cfg.UnhandledSubjectPrefix))
+	return router
+}
 
+// errorTarget reports upload failures on the subject of the upload result and
+// SAS token failures on the subject of the token. The request id is taken
+// from the payload, or from the last subject token when it cannot be decoded.
+func errorTarget(msg jetstream.Msg) (string, string, event.Type, bool) {
+	requestId := msg.Subject()[strings.LastIndex(msg.Subject(), ".")+1:]
+	switch {
+	case SubjectMatches(UploadArtifactSubject, msg.Subject()):
+		if request, ok := uploadRequest(msg); ok && request.AuthRequest.RequestId != "" {
+			requestId = request.AuthRequest.RequestId
 		}
+		return requestId, "artifact.uploadArtifactTargetApplicationResponse." + requestId, event.TypeUploadFailed, true
+	case SubjectMatches(GenerateSASTokenSubject, msg.Subject()):
+		var request artifact.GenerateSASTokenRequest
+		if json.Unmarshal(msg.Data(), &request) == nil && request.RequestId != "" {
+			requestId = request.RequestId
+		}
+		return requestId, "artifact.createSASTokenResponse." + requestId, event.TypeSASTokenFailed, true
+	case SubjectMatches(UploadBatchSubject, msg.Subject()):
+		var batch artifact.UploadBatchRequest
+		if json.Unmarshal(msg.Data(), &batch) == nil && batch.BatchId != "" {
+			requestId = batch.BatchId
+		}
+		return requestId, "artifact.uploadBatchResponse." + requestId, event.TypeBatchFailed, true
+	}
+	return "", "", "", false
+}
 
-	case "artifact.GenerateSASToken.>":
-		{
-			log.Print(msg.Data())
-			_, err := artifact.GenerateNewSASToken(ctx, js, msg, azureServiceClient, cfg)
-			if err != nil {
-				log.Printf("Failed to upload Artifact: %v", err)
-				msg.Ack()
-				return
-			}
+// recordQueued marks the jobs of an upload request, or of the items of a
+// batch, as queued. Only new and failed jobs are queued, so duplicates never
+// reset jobs that are running, completed or cancelled.
+func recordQueued(ctx context.Context, store *jobs.Store, msg jetstream.Msg) {
+	var requests []artifact.UploadArtifactRequest
+	if request, ok := uploadRequest(msg); ok {
+		requests = append(requests, *request)
+	} else if SubjectMatches(UploadBatchSubject, msg.Subject()) {
+		var batch artifact.UploadBatchRequest
+		if json.Unmarshal(msg.Data(), &batch) != nil || batch.BatchId == "" {
 			return
 		}
+		batch.AssignRequestIds()
+		requests = batch.Items
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, syncRequestTimeout)
+	defer cancel()
+
+	for _, request := range requests {
+		if request.AuthRequest.RequestId == "" {
+			continue
+		}
+		_, err := store.Queue(ctx, request.AuthRequest.RequestId, func(job *jobs.Job) {
+			job.Domain = request.AuthRequest.Domain
+			job.ContainerName = request.BlobMetadata.ContainerName
+			job.BlobName = request.BlobMetadata.BlobName
+		})
+		if err != nil {
+			log.Printf("Failed to record queued state of job %s: %v", request.AuthRequest.RequestId, err)
+		}
+	}
+}
 
+// DomainKey returns the Mender domain of an upload request, used to limit the
+// uploads running concurrently per tenant. Other messages have no key, and
+// batches take no slot since each of their items takes one.
+func DomainKey(msg jetstream.Msg) (string, bool) {
+	if SubjectMatches(UploadBatchSubject, msg.Subject()) {
+		return "", false
 	}
+	request, ok := uploadRequest(msg)
+	if !ok {
+		return "", true
+	}
+	return request.AuthRequest.Domain, true
+}
 
+func uploadRequest(msg jetstream.Msg) (*artifact.UploadArtifactRequest, bool) {
+	if !SubjectMatches(UploadArtifactSubject, msg.Subject()) {
+		return nil, false
+	}
+	var request artifact.UploadArtifactRequest
+	if err := json.Unmarshal(msg.Data(), &request); err != nil {
+		return nil, false
+	}
+	return &request, true
 }
 
+func uploadArtifactHandler(pub *publisher.Publisher, uploader *artifact.Uploader, store *idempotency.Store) HandlerFunc {
+	return func(ctx context.Context, msg jetstream.Msg) error {
+		request, _ := Payload[artifact.UploadArtifactRequest](ctx)
+		if err := validateUploadRequest(request); err != nil {
+			return err
+		}
+
+		_, err := processUpload(ctx, pub, uploader, store, msg, request)
+		if errors.Is(err, artifact.ErrUploadCancelled) {
+			return nil
+		}
+		return err
+	}
+}
+
+// validateUploadRequest rejects requests that can never be uploaded before
+// anything is downloaded, so that they are not retried.
+func validateUploadRequest(request *artifact.UploadArtifactRequest) error {
+	var problem string
+	switch {
+	case request.AuthRequest.RequestId == "":
+		problem = "request_data.requestId is required"
+	case request.AuthRequest.Domain == "":
+		problem = "request_data.domain is required"
+	case !validDomain(request.AuthRequest.Domain):
+		problem = fmt.Sprintf("request_data.domain %q is not a host name", request.AuthRequest.Domain)
+	case request.BlobMetadata.ContainerName == "":
+		problem = "Artifact.containerName is required"
+	case request.BlobMetadata.BlobName == "":
+		problem = "Artifact.blobName is required"
+	}
+	if problem != "" {
+		return failure.Permanent(failure.CodeInvalidRequest, fmt.Errorf("%w: %s", ErrInvalidPayload, problem))
+	}
+	return nil
+}
+
+// validDomain reports whether domain is a host, with an optional port, that
+// forms the Mender URL on its own.
+func validDomain(domain string) bool {
+	u, err := url.Parse("https://" + domain)
+	return err == nil && u.Host == domain && u.Hostname() != "" && u.User == nil
+}
+
+// processUpload uploads the artifact of request once. A request that already
+// completed gets its stored result republished instead, and a cancelled one
+// is reported as cancelled.
+func processUpload(ctx context.Context, pub *publisher.Publisher, uploader *artifact.Uploader, store *idempotency.Store, msg jetstream.Msg, request *artifact.UploadArtifactRequest) (*nats.Msg, error) {
+	requestId := request.AuthRequest.RequestId
+	var sequence uint64
+	if meta, err := msg.Metadata(); err == nil {
+		sequence = meta.Sequence.Stream
+	}
+	record, claimed, err := store.Begin(ctx, requestId, sequence)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed && record.State == idempotency.StateCancelled {
+		return uploader.Cancelled(ctx, request)
+	}
+	if !claimed {
+		log.Printf("Request %s was already processed, republishing its result", requestId)
+		if record.Result == nil {
+			return nil, nil
+		}
+		resultMsg := record.Result.Msg()
+		if err := pub.Respond(ctx, resultMsg); err != nil {
+			log.Printf("Failed to publish : %v", err)
+			return nil, failure.Transient(failure.CodeInternal, err)
+		}
+		return resultMsg, nil
+	}
+
+	response, err := uploader.UploadArtifact(ctx, msg, request)
+	if errors.Is(err, artifact.ErrUploadCancelled) {
+		store.Cancel(context.WithoutCancel(ctx), requestId)
+		return response, err
+	}
+	if err != nil {
+		store.Fail(context.WithoutCancel(ctx), requestId, err)
+		return nil, err
+	}
+	store.Complete(context.WithoutCancel(ctx), requestId, response)
+	return response, nil
+}
+
+func generateSASTokenHandler(pub *publisher.Publisher, azureServiceClient *azblob.Client, cfg *config.Config) HandlerFunc {
+	return func(ctx context.Context, msg jetstream.Msg) error {
+		request, _ := Payload[artifact.GenerateSASTokenRequest](ctx)
+		_, err := artifact.GenerateNewSASToken(ctx, pub, msg, request, azureServiceClient, cfg)
+		return err
+	}
+}
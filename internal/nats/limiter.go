@@ -0,0 +1,90 @@
+package nats
+
+import (
+	"context"
+	"sync"
+
+	"github.com/menderartifactsconsumer/internal/metrics"
+)
+
+// Limiter hands out the slots of WORKERS_COUNT: at most workers slots are
+// taken at once, and at most perKey of them for the same non-empty key. The
+// worker pool takes a slot for each message it runs and batches take one for
+// each of their items, so both count against the same limits.
+type Limiter struct {
+	workers int
+	perKey  int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	running int
+	active  map[string]int
+}
+
+func NewLimiter(workers, perKey int) *Limiter {
+	l := &Limiter{
+		workers: workers,
+		perKey:  perKey,
+		active:  make(map[string]int),
+	}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// Acquire waits for a slot for key and returns the function releasing it, or
+// ctx's error when ctx is done first.
+func (l *Limiter) Acquire(ctx context.Context, key string) (release func(), err error) {
+	stop := context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.cond.Broadcast()
+	})
+	defer stop()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for !l.available(key) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		l.cond.Wait()
+	}
+	l.take(key)
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.put(key)
+	}, nil
+}
+
+// available reports whether a slot for key is free. l.mu must be held.
+func (l *Limiter) available(key string) bool {
+	if l.running >= l.workers {
+		return false
+	}
+	return key == "" || l.perKey <= 0 || l.active[key] < l.perKey
+}
+
+// take takes a slot for key. l.mu must be held.
+func (l *Limiter) take(key string) {
+	l.running++
+	l.active[key]++
+	metrics.WorkersActive.Add(1)
+	if key != "" {
+		metrics.WorkersActiveByDomain.Add(key, 1)
+	}
+}
+
+// put releases a slot for key and wakes up the waiters. l.mu must be held.
+func (l *Limiter) put(key string) {
+	l.running--
+	l.active[key]--
+	if l.active[key] == 0 {
+		delete(l.active, key)
+	}
+	metrics.WorkersActive.Add(-1)
+	if key != "" {
+		metrics.WorkersActiveByDomain.Add(key, -1)
+	}
+	l.cond.Broadcast()
+}
@@ -0,0 +1,143 @@
+package nats
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/menderartifactsconsumer/internal/failure"
+	"github.com/menderartifactsconsumer/internal/publisher"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+var (
+	ErrUnauthorized   = errors.New("unauthorized")
+	ErrInvalidPayload = errors.New("invalid payload")
+)
+
+type Middleware func(HandlerFunc) HandlerFunc
+
+// Chain wraps handler with middleware so that the first middleware is the
+// outermost one and runs first.
+func Chain(handler HandlerFunc, middleware ...Middleware) HandlerFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// Reply makes the responses of a message also go to the subject of its
+// Reply-To header.
+func Reply() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg jetstream.Msg) error {
+			return next(publisher.WithReply(ctx, publisher.ReplySubject(msg.Headers())), msg)
+		}
+	}
+}
+
+func Recover() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg jetstream.Msg) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Recovered from panic while handling %s: %v\n%s", msg.Subject(), r, debug.Stack())
+					err = failure.Permanent(failure.CodeInternal, fmt.Errorf("panic while handling %s: %v", msg.Subject(), r))
+				}
+			}()
+			return next(ctx, msg)
+		}
+	}
+}
+
+func Logging() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg jetstream.Msg) error {
+			log.Print("Received message with subject " + msg.Subject())
+			err := next(ctx, msg)
+			if err != nil {
+				log.Printf("Failed to handle message with subject %s: %v", msg.Subject(), err)
+			}
+			return err
+		}
+	}
+}
+
+func Timing() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg jetstream.Msg) error {
+			start := time.Now()
+			err := next(ctx, msg)
+			log.Printf("Handled message with subject %s in %s", msg.Subject(), time.Since(start))
+			return err
+		}
+	}
+}
+
+func Timeout(timeout time.Duration) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg jetstream.Msg) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return next(ctx, msg)
+		}
+	}
+}
+
+type AuthFunc func(ctx context.Context, msg jetstream.Msg) error
+
+func Auth(authorize AuthFunc) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg jetstream.Msg) error {
+			if err := authorize(ctx, msg); err != nil {
+				return failure.Permanent(failure.CodeUnauthorized, fmt.Errorf("%w: %v", ErrUnauthorized, err))
+			}
+			return next(ctx, msg)
+		}
+	}
+}
+
+// HeaderTokenAuth accepts messages whose header carries one of the tokens.
+func HeaderTokenAuth(header string, tokens []string) AuthFunc {
+	return func(ctx context.Context, msg jetstream.Msg) error {
+		return checkToken(header, msg.Headers().Get(header), tokens)
+	}
+}
+
+func checkToken(header, value string, tokens []string) error {
+	if value == "" {
+		return fmt.Errorf("missing %s header", header)
+	}
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare([]byte(value), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid %s header", header)
+}
+
+type payloadKey[T any] struct{}
+
+// DecodeJSON unmarshals the message data into a T that handlers read back
+// with Payload.
+func DecodeJSON[T any]() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg jetstream.Msg) error {
+			var payload T
+			if err := json.Unmarshal(msg.Data(), &payload); err != nil {
+				return failure.Permanent(failure.CodeInvalidRequest, fmt.Errorf("%w: %v", ErrInvalidPayload, err))
+			}
+			return next(context.WithValue(ctx, payloadKey[T]{}, &payload), msg)
+		}
+	}
+}
+
+func Payload[T any](ctx context.Context) (*T, bool) {
+	payload, ok := ctx.Value(payloadKey[T]{}).(*T)
+	return payload, ok
+}
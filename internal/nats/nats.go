@@ -2,22 +2,59 @@ package nats
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"time"
 
-	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	"github.com/menderartifactsconsumer/internal/config"
+	"github.com/menderartifactsconsumer/internal/jobs"
+	"github.com/menderartifactsconsumer/internal/publisher"
 	nats "github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
 )
 
-func Connect(url string) (*nats.Conn, error) {
-	nc, err := nats.Connect(url, nats.Name("Mender Producer"))
+func Connect(cfg *config.Config) (*nats.Conn, error) {
+	opts, err := connectOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	nc, err := nats.Connect(cfg.NATSURL, opts...)
 	if err != nil {
 		return nil, err
 	}
 	return nc, nil
 }
 
+func connectOptions(cfg *config.Config) ([]nats.Option, error) {
+	opts := []nats.Option{nats.Name("Mender Producer")}
+
+	switch {
+	case cfg.NATSCredentials != "":
+		opts = append(opts, nats.UserCredentials(cfg.NATSCredentials))
+	case cfg.NATSNKeySeedFile != "":
+		opt, err := nats.NkeyOptionFromSeed(cfg.NATSNKeySeedFile)
+		if err != nil {
+			log.Printf("Failed to load NKey seed: %v", err)
+			return nil, err
+		}
+		opts = append(opts, opt)
+	case cfg.NATSToken != "":
+		opts = append(opts, nats.Token(cfg.NATSToken))
+	case cfg.NATSUser != "":
+		opts = append(opts, nats.UserInfo(cfg.NATSUser, cfg.NATSPassword))
+	}
+
+	if cfg.NATSTLS.CAFile != "" {
+		opts = append(opts, nats.RootCAs(cfg.NATSTLS.CAFile))
+	}
+	if cfg.NATSTLS.CertFile != "" {
+		opts = append(opts, nats.ClientCert(cfg.NATSTLS.CertFile, cfg.NATSTLS.KeyFile))
+	}
+
+	return opts, nil
+}
+
 func SetupJetStream(nc *nats.Conn) (jetstream.JetStream, error) {
 	js, err := jetstream.New(nc)
 	if err != nil {
@@ -26,29 +63,103 @@ func SetupJetStream(nc *nats.Conn) (jetstream.JetStream, error) {
 	return js, nil
 }
 
-func InitStreamAndConsumer(nc *nats.Conn, ctx context.Context, js jetstream.JetStream, azureServiceClient *azblob.Client, cfg *config.Config) {
-	stream, err := js.Stream(ctx, "MenderUser")
+func InitStreamAndConsumer(nc *nats.Conn, ctx context.Context, js jetstream.JetStream, pub *publisher.Publisher, router *Router, limiter *Limiter, jobStore *jobs.Store, cfg *config.Config) (*Consumer, error) {
+	stream, err := js.CreateOrUpdateStream(ctx, streamConfig(cfg))
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Failed to create or update stream %s: %v", cfg.Stream.Name, err)
+		return nil, err
 	}
 
-	consumer, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
-		Name:           "mender_artifact",
-		Durable:        "mender_artifact",
-		FilterSubjects: []string{"artifact.GenerateSASToken.>", "artifact.uploadArtifact.>"},
-	})
+	consumer, err := stream.CreateOrUpdateConsumer(ctx, consumerConfig(cfg, router))
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Failed to create or update consumer %s: %v", cfg.Consumer.Name, err)
+		return nil, err
+	}
+
+	if _, err := SubscribeMaxDeliveries(nc, stream, pub, cfg); err != nil {
+		return nil, err
+	}
+
+	c := NewConsumer(pub, consumer, router, limiter, jobStore, cfg)
+	if err := c.Start(); err != nil {
+		return nil, err
 	}
 
 	log.Print("Waiting for messages..")
-	cctx, err := consumer.Consume(func(msgs jetstream.Msg) {
-		handleRequest(js, msgs, azureServiceClient, cfg)
-		msgs.Ack()
-	})
-	if err != nil {
-		log.Fatal(err)
+	return c, nil
+}
+
+func streamConfig(cfg *config.Config) jetstream.StreamConfig {
+	retention := jetstream.LimitsPolicy
+	switch cfg.Stream.Retention {
+	case "interest":
+		retention = jetstream.InterestPolicy
+	case "workqueue":
+		retention = jetstream.WorkQueuePolicy
+	}
+
+	storage := jetstream.FileStorage
+	if cfg.Stream.Storage == "memory" {
+		storage = jetstream.MemoryStorage
+	}
+
+	return jetstream.StreamConfig{
+		Name:      cfg.Stream.Name,
+		Subjects:  cfg.Stream.Subjects,
+		Retention: retention,
+		Storage:   storage,
+		Replicas:  cfg.Stream.Replicas,
+		MaxAge:    cfg.Stream.MaxAge,
+	}
+}
+
+// ackPendingPerWorker is the number of unacknowledged messages pulled per
+// worker when consumer.max_ack_pending is not set.
+const ackPendingPerWorker = 4
+
+// consumerConfig filters on the configured subjects, or on every pattern the
+// router handles when none are configured.
+func consumerConfig(cfg *config.Config, router *Router) jetstream.ConsumerConfig {
+	filterSubjects := cfg.Consumer.FilterSubjects
+	if len(filterSubjects) == 0 {
+		filterSubjects = router.Patterns()
+	}
+
+	// Without an explicit limit, pull a few messages per worker: with only
+	// as many as there are workers, the backlog of one domain would fill
+	// every pending slot and the per-domain limit would never let the
+	// messages of other domains through.
+	maxAckPending := cfg.Consumer.MaxAckPending
+	if maxAckPending == 0 {
+		maxAckPending = cfg.Workers.Count * ackPendingPerWorker
+	}
+
+	return jetstream.ConsumerConfig{
+		Name:           cfg.Consumer.Name,
+		Durable:        cfg.Consumer.Name,
+		FilterSubjects: filterSubjects,
+		AckPolicy:      jetstream.AckExplicitPolicy,
+		AckWait:        cfg.Consumer.AckWait,
+		MaxDeliver:     cfg.Consumer.MaxDeliver,
+		MaxAckPending:  maxAckPending,
+		BackOff:        cfg.Consumer.BackOff,
+	}
+}
+
+// Drain drains the connection and waits until it is closed or timeout passes.
+func Drain(nc *nats.Conn, timeout time.Duration) error {
+	closed := make(chan struct{})
+	nc.SetClosedHandler(func(*nats.Conn) { close(closed) })
+
+	if err := nc.Drain(); err != nil {
+		return err
+	}
+
+	select {
+	case <-closed:
+		return nil
+	case <-time.After(timeout):
+		nc.Close()
+		return fmt.Errorf("timed out draining NATS connection after %s", timeout)
 	}
-	defer cctx.Stop()
-	select {}
 }
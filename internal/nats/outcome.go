@@ -0,0 +1,68 @@
+package nats
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/menderartifactsconsumer/internal/failure"
+	"github.com/menderartifactsconsumer/internal/idempotency"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// settle acks a successfully handled message, or a duplicate of a request
+// still being processed, and naks it with a backoff delay on a transient
+// failure. Permanent failures and messages on their last
+// delivery attempt are moved to the dead-letter subject and terminated; they
+// are nakked instead when the dead letter could not be published, so the
+// message stays in the stream.
+func (c *Consumer) settle(msg jetstream.Msg, err error) {
+	if errors.Is(err, idempotency.ErrInProgress) {
+		log.Printf("Dropping duplicate message with subject %s: %v", msg.Subject(), err)
+		err = nil
+	}
+	if err == nil {
+		if err := msg.Ack(); err != nil {
+			log.Printf("Failed to ack message with subject %s: %v", msg.Subject(), err)
+		}
+		return
+	}
+
+	if !failure.IsPermanent(err) && !lastDelivery(msg, c.cfg.Consumer.MaxDeliver) {
+		delay := redeliveryDelay(msg, c.cfg.RetryBackoff)
+		log.Printf("Retrying message with subject %s in %s: %v", msg.Subject(), delay, err)
+		if err := msg.NakWithDelay(delay); err != nil {
+			log.Printf("Failed to nak message with subject %s: %v", msg.Subject(), err)
+		}
+		return
+	}
+
+	if !failure.IsPermanent(err) {
+		err = fmt.Errorf("max deliveries reached: %w", err)
+	}
+	log.Printf("Terminating message with subject %s: %v", msg.Subject(), err)
+	if dlqErr := deadLetter(c.publisher, msg, c.cfg.DeadLetterSubjectPrefix, []string{c.cfg.AuthHeader}, err); dlqErr != nil {
+		if err := msg.NakWithDelay(redeliveryDelay(msg, c.cfg.RetryBackoff)); err != nil {
+			log.Printf("Failed to nak message with subject %s: %v", msg.Subject(), err)
+		}
+		return
+	}
+	if err := msg.Term(); err != nil {
+		log.Printf("Failed to term message with subject %s: %v", msg.Subject(), err)
+	}
+}
+
+func redeliveryDelay(msg jetstream.Msg, backoff []time.Duration) time.Duration {
+	if len(backoff) == 0 {
+		return 0
+	}
+	attempt := 0
+	if meta, err := msg.Metadata(); err == nil && meta.NumDelivered > 0 {
+		attempt = int(meta.NumDelivered) - 1
+	}
+	if attempt >= len(backoff) {
+		attempt = len(backoff) - 1
+	}
+	return backoff[attempt]
+}
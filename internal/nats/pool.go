@@ -0,0 +1,170 @@
+package nats
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/menderartifactsconsumer/internal/metrics"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+type task struct {
+	msg  jetstream.Msg
+	key  string
+	slot bool
+}
+
+// KeyFunc returns the key of msg and whether msg takes a slot of the
+// limiter. Messages that only coordinate work taking its own slots, like
+// batches, take none.
+type KeyFunc func(msg jetstream.Msg) (key string, slot bool)
+
+// Pool runs queued messages on a fixed number of workers, each message under
+// a slot of the limiter. Messages whose key is at its limit wait in the queue
+// while other keys are served.
+type Pool struct {
+	limiter   *Limiter
+	keyFunc   KeyFunc
+	handle    func(jetstream.Msg)
+	heartbeat time.Duration
+
+	// The queue is guarded by the mutex of the limiter, so that workers
+	// wake up when slots are released outside the pool.
+	queue  []task
+	closed bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewPool(limiter *Limiter, heartbeat time.Duration, keyFunc KeyFunc, handle func(jetstream.Msg)) *Pool {
+	return &Pool{
+		limiter:   limiter,
+		keyFunc:   keyFunc,
+		handle:    handle,
+		heartbeat: heartbeat,
+		done:      make(chan struct{}),
+	}
+}
+
+func (p *Pool) Start() {
+	for i := 0; i < p.limiter.workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	if p.heartbeat > 0 {
+		go p.keepQueuedAlive()
+	}
+}
+
+// Submit queues msg. It returns false without queueing once the pool is closed.
+func (p *Pool) Submit(msg jetstream.Msg) bool {
+	key, slot := p.keyFunc(msg)
+
+	p.limiter.mu.Lock()
+	defer p.limiter.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.queue = append(p.queue, task{msg: msg, key: key, slot: slot})
+	metrics.WorkersQueued.Set(int64(len(p.queue)))
+	p.limiter.cond.Broadcast()
+	return true
+}
+
+// Close stops the workers after their current message and naks every message
+// still queued so that it is redelivered right away.
+func (p *Pool) Close() {
+	p.limiter.mu.Lock()
+	if p.closed {
+		p.limiter.mu.Unlock()
+		return
+	}
+	p.closed = true
+	queued := p.queue
+	p.queue = nil
+	metrics.WorkersQueued.Set(0)
+	close(p.done)
+	p.limiter.cond.Broadcast()
+	p.limiter.mu.Unlock()
+
+	for _, t := range queued {
+		t.msg.Nak()
+	}
+}
+
+// Wait blocks until every worker has returned after Close.
+func (p *Pool) Wait() {
+	p.wg.Wait()
+}
+
+func (p *Pool) work() {
+	defer p.wg.Done()
+	for {
+		t, ok := p.next()
+		if !ok {
+			return
+		}
+		p.handle(t.msg)
+		p.release(t)
+	}
+}
+
+// next removes the first queued message that needs no slot or whose slot is
+// available, waiting until there is one or the pool is closed.
+func (p *Pool) next() (task, bool) {
+	l := p.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		if p.closed {
+			return task{}, false
+		}
+		for i, t := range p.queue {
+			if t.slot && !l.available(t.key) {
+				continue
+			}
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			if t.slot {
+				l.take(t.key)
+			}
+			metrics.WorkersQueued.Set(int64(len(p.queue)))
+			return t, true
+		}
+		l.cond.Wait()
+	}
+}
+
+func (p *Pool) release(t task) {
+	if !t.slot {
+		return
+	}
+	p.limiter.mu.Lock()
+	defer p.limiter.mu.Unlock()
+	p.limiter.put(t.key)
+}
+
+// keepQueuedAlive sends in-progress acks for queued messages so that they are
+// not redelivered while waiting for a worker.
+func (p *Pool) keepQueuedAlive() {
+	ticker := time.NewTicker(p.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		p.limiter.mu.Lock()
+		queued := make([]task, len(p.queue))
+		copy(queued, p.queue)
+		p.limiter.mu.Unlock()
+
+		for _, t := range queued {
+			if err := t.msg.InProgress(); err != nil {
+				log.Printf("Failed to send in-progress heartbeat for queued %s: %v", t.msg.Subject(), err)
+			}
+		}
+	}
+}
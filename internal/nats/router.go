@@ -0,0 +1,139 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/menderartifactsconsumer/internal/event"
+	"github.com/menderartifactsconsumer/internal/failure"
+	"github.com/menderartifactsconsumer/internal/publisher"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+type HandlerFunc func(ctx context.Context, msg jetstream.Msg) error
+
+type route struct {
+	pattern string
+	tokens  []string
+	handler HandlerFunc
+}
+
+// Router dispatches messages to the handler of the first registered pattern
+// matching the message subject. Patterns use NATS wildcards: `*` matches a
+// single token and `>` matches one or more trailing tokens.
+type Router struct {
+	routes     []route
+	fallback   HandlerFunc
+	middleware []Middleware
+}
+
+func NewRouter() *Router {
+	return &Router{
+		fallback: func(ctx context.Context, msg jetstream.Msg) error {
+			return failure.Permanent(failure.CodeInvalidRequest, fmt.Errorf("no handler registered for subject %s", msg.Subject()))
+		},
+	}
+}
+
+// Handle registers handler for pattern. The middleware given here only wraps
+// this route and runs inside the middleware registered with Use.
+func (r *Router) Handle(pattern string, handler HandlerFunc, middleware ...Middleware) {
+	tokens, err := parsePattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+	r.routes = append(r.routes, route{pattern: pattern, tokens: tokens, handler: Chain(handler, middleware...)})
+}
+
+// Use adds middleware that wraps every route and the fallback.
+func (r *Router) Use(middleware ...Middleware) {
+	r.middleware = append(r.middleware, middleware...)
+}
+
+func (r *Router) Fallback(handler HandlerFunc) {
+	r.fallback = handler
+}
+
+func (r *Router) Patterns() []string {
+	patterns := make([]string, 0, len(r.routes))
+	for _, rt := range r.routes {
+		patterns = append(patterns, rt.pattern)
+	}
+	return patterns
+}
+
+func (r *Router) Match(subject string) (HandlerFunc, bool) {
+	tokens := strings.Split(subject, ".")
+	for _, rt := range r.routes {
+		if matchTokens(rt.tokens, tokens) {
+			return rt.handler, true
+		}
+	}
+	return r.fallback, false
+}
+
+func (r *Router) Dispatch(ctx context.Context, msg jetstream.Msg) error {
+	handler, _ := r.Match(msg.Subject())
+	return Chain(handler, r.middleware...)(ctx, msg)
+}
+
+// SubjectMatches reports whether subject matches the wildcard pattern.
+func SubjectMatches(pattern, subject string) bool {
+	tokens, err := parsePattern(pattern)
+	return err == nil && matchTokens(tokens, strings.Split(subject, "."))
+}
+
+func parsePattern(pattern string) ([]string, error) {
+	tokens := strings.Split(pattern, ".")
+	for i, token := range tokens {
+		switch {
+		case token == "":
+			return nil, fmt.Errorf("invalid subject pattern %q: empty token", pattern)
+		case token == ">" && i != len(tokens)-1:
+			return nil, fmt.Errorf("invalid subject pattern %q: '>' must be the last token", pattern)
+		case token != "*" && token != ">" && strings.ContainsAny(token, "*> \t"):
+			return nil, fmt.Errorf("invalid subject pattern %q: wildcards must be whole tokens", pattern)
+		}
+	}
+	return tokens, nil
+}
+
+func matchTokens(pattern, subject []string) bool {
+	for i, token := range pattern {
+		if token == ">" {
+			return len(subject) > i
+		}
+		if i >= len(subject) {
+			return false
+		}
+		if token != "*" && token != subject[i] {
+			return false
+		}
+	}
+	return len(pattern) == len(subject)
+}
+
+type UnhandledSubject struct {
+	Subject string `json:"subject"`
+}
+
+// ErrorReplyFallback returns a fallback handler that publishes a
+// request.unhandled event for unmatched messages on <prefix>.<original subject>.
+func ErrorReplyFallback(pub *publisher.Publisher, prefix string) HandlerFunc {
+	return func(ctx context.Context, msg jetstream.Msg) error {
+		log.Printf("No handler registered for subject %s", msg.Subject())
+
+		requestId := msg.Subject()[strings.LastIndex(msg.Subject(), ".")+1:]
+		unhandled := event.New(requestId, event.TypeUnhandled, event.StatusFailed).
+			WithMessage("no handler registered for subject").
+			WithData(UnhandledSubject{Subject: msg.Subject()})
+		if err := pub.Respond(ctx, unhandled.Msg(prefix+"."+msg.Subject(), http.StatusNotFound)); err != nil {
+			log.Printf("Failed to publish : %v", err)
+			return err
+		}
+		return nil
+	}
+}
@@ -0,0 +1,69 @@
+package nats
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		wantErr bool
+	}{
+		{pattern: "artifact.uploadArtifact.>"},
+		{pattern: "artifact.status.*"},
+		{pattern: "artifact.*.request"},
+		{pattern: ">"},
+		{pattern: "artifact.>.request", wantErr: true},
+		{pattern: "artifact..status", wantErr: true},
+		{pattern: "artifact.status.", wantErr: true},
+		{pattern: "artifact.status*", wantErr: true},
+		{pattern: "artifact.up>", wantErr: true},
+		{pattern: "artifact.up load", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			tokens, err := parsePattern(tt.pattern)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePattern(%q) error = %v, want error %t", tt.pattern, err, tt.wantErr)
+			}
+			if err == nil && strings.Join(tokens, ".") != tt.pattern {
+				t.Errorf("parsePattern(%q) = %q", tt.pattern, tokens)
+			}
+		})
+	}
+}
+
+func TestMatchTokens(t *testing.T) {
+	tests := []struct {
+		pattern string
+		subject string
+		want    bool
+	}{
+		{pattern: "artifact.status.abc", subject: "artifact.status.abc", want: true},
+		{pattern: "artifact.status.abc", subject: "artifact.status.def"},
+		{pattern: "artifact.status.*", subject: "artifact.status.abc", want: true},
+		{pattern: "artifact.status.*", subject: "artifact.status"},
+		{pattern: "artifact.status.*", subject: "artifact.status.abc.def"},
+		{pattern: "artifact.*.abc", subject: "artifact.status.abc", want: true},
+		{pattern: "artifact.uploadArtifact.>", subject: "artifact.uploadArtifact.abc", want: true},
+		{pattern: "artifact.uploadArtifact.>", subject: "artifact.uploadArtifact.abc.def", want: true},
+		{pattern: "artifact.uploadArtifact.>", subject: "artifact.uploadArtifact"},
+		{pattern: "artifact.uploadArtifact.>", subject: "artifact.uploadBatch.abc"},
+		{pattern: ">", subject: "artifact", want: true},
+		{pattern: "artifact", subject: "artifact.status"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.subject, func(t *testing.T) {
+			pattern, err := parsePattern(tt.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := matchTokens(pattern, strings.Split(tt.subject, ".")); got != tt.want {
+				t.Errorf("matchTokens(%q, %q) = %t, want %t", tt.pattern, tt.subject, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/menderartifactsconsumer/internal/artifact"
+	storageClient "github.com/menderartifactsconsumer/internal/azblob"
+	"github.com/menderartifactsconsumer/internal/config"
+	"github.com/menderartifactsconsumer/internal/event"
+	"github.com/menderartifactsconsumer/internal/failure"
+	"github.com/menderartifactsconsumer/internal/jobs"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+// ServiceVersion is reported by $SRV.INFO. It follows the version of the
+// synchronous endpoints and their responses.
+const ServiceVersion = "1.0.0"
+
+const (
+	CreateSASTokenSubject = "artifact.createSASToken"
+	JobStatusSubject      = "artifact.status.*"
+	ListStatusSubject     = "artifact.listStatus"
+
+	syncRequestTimeout = 10 * time.Second
+)
+
+type JobStatusResponse struct {
+	Job *jobs.Job `json:"job"`
+}
+
+type ListStatusResponse struct {
+	Jobs []jobs.Job `json:"jobs"`
+}
+
+// AddArtifactService serves the synchronous operations as a NATS micro
+// service, which answers $SRV.PING, $SRV.INFO and $SRV.STATS discovery
+// requests and shares the requests between instances through a queue group.
+// Errors are returned with the Nats-Service-Error-Code header set to a
+// failure code.
+func AddArtifactService(nc *nats.Conn, store *jobs.Store, cfg *config.Config) (micro.Service, error) {
+	svc, err := micro.AddService(nc, micro.Config{
+		Name:        cfg.Service.Name,
+		Version:     ServiceVersion,
+		Description: "Mender artifact SAS tokens and upload job status",
+		QueueGroup:  cfg.Service.QueueGroup,
+	})
+	if err != nil {
+		log.Printf("Failed to add service %s: %v", cfg.Service.Name, err)
+		return nil, err
+	}
+
+	endpoints := []struct {
+		name      string
+		subject   string
+		eventType event.Type
+		handler   micro.HandlerFunc
+	}{
+		{"createSASToken", CreateSASTokenSubject, event.TypeSASTokenFailed, createSASTokenEndpoint(cfg)},
+		{"jobStatus", JobStatusSubject, event.TypeJobStatus, jobStatusEndpoint(store)},
+		{"listStatus", ListStatusSubject, event.TypeJobList, listStatusEndpoint(store)},
+	}
+	for _, endpoint := range endpoints {
+		handler := endpoint.handler
+		if len(cfg.AuthTokens) > 0 {
+			handler = authorizeRequest(cfg.AuthHeader, cfg.AuthTokens, endpoint.eventType, handler)
+		}
+		if err := svc.AddEndpoint(endpoint.name, handler, micro.WithEndpointSubject(endpoint.subject)); err != nil {
+			log.Printf("Failed to add endpoint %s: %v", endpoint.name, err)
+			svc.Stop()
+			return nil, err
+		}
+	}
+	return svc, nil
+}
+
+// authorizeRequest answers requests without a valid token with a failed
+// event of eventType.
+func authorizeRequest(header string, tokens []string, eventType event.Type, next micro.HandlerFunc) micro.HandlerFunc {
+	return func(req micro.Request) {
+		if err := checkToken(header, req.Headers().Get(header), tokens); err != nil {
+			respondError(req, "", eventType, failure.Permanent(failure.CodeUnauthorized, fmt.Errorf("%w: %v", ErrUnauthorized, err)))
+			return
+		}
+		next(req)
+	}
+}
+
+// createSASTokenEndpoint answers with a sas_token.created event, or an error
+// carrying a sas_token.failed event.
+func createSASTokenEndpoint(cfg *config.Config) micro.HandlerFunc {
+	return func(req micro.Request) {
+		var request artifact.GenerateSASTokenRequest
+		if err := json.Unmarshal(req.Data(), &request); err != nil {
+			respondError(req, request.RequestId, event.TypeSASTokenFailed, failure.Permanent(failure.CodeInvalidRequest, fmt.Errorf("%w: %v", ErrInvalidPayload, err)))
+			return
+		}
+		if request.ContainerName == "" || request.BlobName == "" {
+			respondError(req, request.RequestId, event.TypeSASTokenFailed, failure.Permanent(failure.CodeInvalidRequest, fmt.Errorf("%w: containerName and blobName are required", ErrInvalidPayload)))
+			return
+		}
+
+		token, err := storageClient.CreateSASToken(cfg, request.ContainerName, request.BlobName)
+		if err != nil {
+			respondError(req, request.RequestId, event.TypeSASTokenFailed, artifact.SASTokenError(err))
+			return
+		}
+		respondEvent(req, event.New(request.RequestId, event.TypeSASTokenCreated, event.StatusCompleted).WithData(token))
+	}
+}
+
+// jobStatusEndpoint answers with a job.status event holding the job.
+func jobStatusEndpoint(store *jobs.Store) micro.HandlerFunc {
+	return func(req micro.Request) {
+		ctx, cancel := context.WithTimeout(context.Background(), syncRequestTimeout)
+		defer cancel()
+
+		requestId := req.Subject()[strings.LastIndex(req.Subject(), ".")+1:]
+		job, err := store.Get(ctx, requestId)
+		switch {
+		case errors.Is(err, jobs.ErrNotFound):
+			respondError(req, requestId, event.TypeJobStatus, failure.Permanent(failure.CodeNotFound, err))
+		case err != nil:
+			log.Printf("Failed to get job %s: %v", requestId, err)
+			respondError(req, requestId, event.TypeJobStatus, err)
+		default:
+			respondEvent(req, event.New(requestId, event.TypeJobStatus, event.StatusCompleted).WithData(JobStatusResponse{Job: job}))
+		}
+	}
+}
+
+// listStatusEndpoint answers with a job.list event holding the matching jobs.
+func listStatusEndpoint(store *jobs.Store) micro.HandlerFunc {
+	return func(req micro.Request) {
+		ctx, cancel := context.WithTimeout(context.Background(), syncRequestTimeout)
+		defer cancel()
+
+		var filter jobs.Filter
+		if len(req.Data()) > 0 {
+			if err := json.Unmarshal(req.Data(), &filter); err != nil {
+				respondError(req, "", event.TypeJobList, failure.Permanent(failure.CodeInvalidRequest, fmt.Errorf("%w: %v", ErrInvalidPayload, err)))
+				return
+			}
+		}
+
+		list, err := store.List(ctx, filter)
+		if err != nil {
+			log.Printf("Failed to list jobs: %v", err)
+			respondError(req, "", event.TypeJobList, err)
+			return
+		}
+		respondEvent(req, event.New("", event.TypeJobList, event.StatusCompleted).WithData(ListStatusResponse{Jobs: list}))
+	}
+}
+
+// respondEvent answers req with e and its Schema-Version and Event-Type
+// headers, like the events published on response subjects.
+func respondEvent(req micro.Request, e event.Event) {
+	msg := e.Msg(req.Subject(), 0)
+	if err := req.Respond(msg.Data, micro.WithHeaders(micro.Headers(msg.Header))); err != nil {
+		log.Printf("Failed to respond on %s: %v", req.Subject(), err)
+	}
+}
+
+// respondError answers req with the service error of err and a failed event
+// of eventType as the body.
+func respondError(req micro.Request, requestId string, eventType event.Type, err error) {
+	details := FailureDetails{UpstreamStatusCode: failure.StatusCode(err), Final: true}
+	msg := failureEvent(requestId, eventType, err, details).Msg(req.Subject(), details.UpstreamStatusCode)
+	if err := req.Error(string(failure.CodeOf(err)), failure.Message(err), msg.Data, micro.WithHeaders(micro.Headers(msg.Header))); err != nil {
+		log.Printf("Failed to respond on %s: %v", req.Subject(), err)
+	}
+}
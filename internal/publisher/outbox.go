@@ -0,0 +1,104 @@
+package publisher
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/menderartifactsconsumer/internal/metrics"
+	nats "github.com/nats-io/nats.go"
+)
+
+const outboxExt = ".json"
+
+type outboxEntry struct {
+	Subject string      `json:"subject"`
+	Header  nats.Header `json:"header,omitempty"`
+	Data    []byte      `json:"data"`
+}
+
+// Outbox spools messages as one file each in a directory. File names start
+// with the spool time so listing them returns the spool order.
+type Outbox struct {
+	dir string
+
+	mu  sync.Mutex
+	seq uint64
+}
+
+func OpenOutbox(dir string) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	o := &Outbox{dir: dir}
+	entries, err := o.List()
+	if err != nil {
+		return nil, err
+	}
+	metrics.OutboxPending.Set(int64(len(entries)))
+	return o, nil
+}
+
+func (o *Outbox) Put(msg *nats.Msg) error {
+	value, err := json.Marshal(outboxEntry{Subject: msg.Subject, Header: msg.Header, Data: msg.Data})
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	o.seq++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), o.seq%1000000, outboxExt)
+	o.mu.Unlock()
+
+	// Write to a temporary file first so a crash never leaves a partial entry.
+	tmp := filepath.Join(o.dir, "."+name)
+	if err := os.WriteFile(tmp, value, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(o.dir, name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	metrics.OutboxPending.Add(1)
+	return nil
+}
+
+// List returns the names of the spooled entries, oldest first.
+func (o *Outbox) List() ([]string, error) {
+	files, err := os.ReadDir(o.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		name := file.Name()
+		if file.Type().IsRegular() && !strings.HasPrefix(name, ".") && strings.HasSuffix(name, outboxExt) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (o *Outbox) Get(name string) (*nats.Msg, error) {
+	value, err := os.ReadFile(filepath.Join(o.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	var entry outboxEntry
+	if err := json.Unmarshal(value, &entry); err != nil {
+		return nil, err
+	}
+	return &nats.Msg{Subject: entry.Subject, Header: entry.Header, Data: entry.Data}, nil
+}
+
+func (o *Outbox) Remove(name string) {
+	if err := os.Remove(filepath.Join(o.dir, name)); err == nil {
+		metrics.OutboxPending.Add(-1)
+	}
+}
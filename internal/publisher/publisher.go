@@ -0,0 +1,162 @@
+package publisher
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/menderartifactsconsumer/internal/config"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Publisher publishes messages to JetStream and waits for their acks. Failed
+// publishes are retried with backoff and finally spooled to a local outbox
+// that is flushed in the background once JetStream accepts messages again.
+type Publisher struct {
+	nc     *nats.Conn
+	js     jetstream.JetStream
+	cfg    config.PublisherConfig
+	outbox *Outbox
+
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+}
+
+func New(nc *nats.Conn, js jetstream.JetStream, cfg config.PublisherConfig) (*Publisher, error) {
+	outbox, err := OpenOutbox(cfg.OutboxDir)
+	if err != nil {
+		log.Printf("Failed to open outbox %s: %v", cfg.OutboxDir, err)
+		return nil, err
+	}
+	return &Publisher{nc: nc, js: js, cfg: cfg, outbox: outbox}, nil
+}
+
+// Start flushes the outbox every flush interval until Close is called.
+func (p *Publisher) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+
+	p.done.Add(1)
+	go func() {
+		defer p.done.Done()
+		ticker := time.NewTicker(p.cfg.FlushInterval)
+		defer ticker.Stop()
+		for {
+			p.Flush(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Close stops flushing the outbox. Spooled messages stay on disk for the next
+// start.
+func (p *Publisher) Close() {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	p.done.Wait()
+}
+
+// notifyStallWait bounds how long Notify waits when too many asynchronous
+// publishes are pending.
+const notifyStallWait = 50 * time.Millisecond
+
+// Publish sends msg and waits for its ack, retrying after each configured
+// backoff delay until ctx is done. A Nats-Msg-Id header is set when missing
+// so that retries and outbox flushes are deduplicated by the stream. A
+// message that could not be published is spooled to the outbox; an error is
+// only returned when that fails too.
+func (p *Publisher) Publish(ctx context.Context, msg *nats.Msg) error {
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	if msg.Header.Get(nats.MsgIdHdr) == "" {
+		msg.Header.Set(nats.MsgIdHdr, uuid.NewString())
+	}
+
+	err := p.publish(msg)
+retries:
+	for _, delay := range p.cfg.RetryBackoff {
+		if err == nil {
+			return nil
+		}
+		log.Printf("Failed to publish %s, retrying in %s: %v", msg.Subject, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			break retries
+		case <-timer.C:
+		}
+		err = p.publish(msg)
+	}
+	if err == nil {
+		return nil
+	}
+
+	log.Printf("Failed to publish %s, spooling it to the outbox: %v", msg.Subject, err)
+	if err := p.outbox.Put(msg); err != nil {
+		log.Printf("Failed to spool %s to the outbox: %v", msg.Subject, err)
+		return err
+	}
+	return nil
+}
+
+// Notify publishes msg without waiting for its ack, retrying or spooling it.
+// A message that cannot be published is logged and dropped, which suits
+// events superseded by the next one, like progress.
+func (p *Publisher) Notify(msg *nats.Msg) {
+	future, err := p.js.PublishMsgAsync(msg, jetstream.WithStallWait(notifyStallWait))
+	if err != nil {
+		log.Printf("Dropping %s: %v", msg.Subject, err)
+		return
+	}
+	go func() {
+		select {
+		case <-future.Ok():
+		case err := <-future.Err():
+			log.Printf("Dropping %s: %v", msg.Subject, err)
+		}
+	}()
+}
+
+// Flush publishes the spooled messages in the order they were spooled. It
+// stops at the first message that still cannot be published.
+func (p *Publisher) Flush(ctx context.Context) {
+	entries, err := p.outbox.List()
+	if err != nil {
+		log.Printf("Failed to list outbox: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		msg, err := p.outbox.Get(entry)
+		if err != nil {
+			log.Printf("Discarding unreadable outbox entry %s: %v", entry, err)
+			p.outbox.Remove(entry)
+			continue
+		}
+		if err := p.publish(msg); err != nil {
+			log.Printf("Failed to flush outbox: %v", err)
+			return
+		}
+		p.outbox.Remove(entry)
+		log.Printf("Flushed %s from the outbox", msg.Subject)
+	}
+}
+
+func (p *Publisher) publish(msg *nats.Msg) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.AckTimeout)
+	defer cancel()
+	_, err := p.js.PublishMsg(ctx, msg)
+	return err
+}
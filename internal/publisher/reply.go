@@ -0,0 +1,51 @@
+package publisher
+
+import (
+	"context"
+	"log"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// ReplyToHeader names the subject a requester wants the response on. Requests
+// are consumed from JetStream, whose reply subject is the ack subject of the
+// consumer rather than the one of the requester.
+const ReplyToHeader = "Reply-To"
+
+type replyKey struct{}
+
+// WithReply returns a context whose responses are also sent to subject. An
+// empty subject stops responses from going to the reply subject of ctx.
+func WithReply(ctx context.Context, subject string) context.Context {
+	return context.WithValue(ctx, replyKey{}, subject)
+}
+
+// ReplySubject returns the subject a message asks to be answered on, from its
+// Reply-To header.
+func ReplySubject(header nats.Header) string {
+	return header.Get(ReplyToHeader)
+}
+
+// Respond publishes msg and, when ctx carries a reply subject, also sends a
+// copy of it there over core NATS. Reply inboxes are not captured by streams,
+// so the copy is neither acked nor spooled.
+func (p *Publisher) Respond(ctx context.Context, msg *nats.Msg) error {
+	err := p.Publish(ctx, msg)
+
+	subject, _ := ctx.Value(replyKey{}).(string)
+	if subject == "" {
+		return err
+	}
+	reply := nats.NewMsg(subject)
+	for key, values := range msg.Header {
+		for _, value := range values {
+			reply.Header.Add(key, value)
+		}
+	}
+	reply.Header.Del(nats.MsgIdHdr)
+	reply.Data = msg.Data
+	if replyErr := p.nc.PublishMsg(reply); replyErr != nil {
+		log.Printf("Failed to reply to %s on %s: %v", msg.Subject, subject, replyErr)
+	}
+	return err
+}
@@ -3,11 +3,18 @@ package main
 import (
 	"context"
 	"log"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/menderartifactsconsumer/internal/artifact"
 	azureclient "github.com/menderartifactsconsumer/internal/azblob"
 	"github.com/menderartifactsconsumer/internal/config"
+	"github.com/menderartifactsconsumer/internal/idempotency"
+	"github.com/menderartifactsconsumer/internal/jobs"
+	"github.com/menderartifactsconsumer/internal/metrics"
 	"github.com/menderartifactsconsumer/internal/nats"
+	"github.com/menderartifactsconsumer/internal/publisher"
 )
 
 func main() {
@@ -16,7 +23,10 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	nc, err := nats.Connect(cfg.NATSURL)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	nc, err := nats.Connect(cfg)
 	if err != nil {
 		log.Fatalf("Failed to connect to NATS: %v", err)
 	}
@@ -27,14 +37,72 @@ func main() {
 		log.Fatal(err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
-	defer cancel()
+	pub, err := publisher.New(nc, js, cfg.Publisher)
+	if err != nil {
+		log.Fatalf("Failed to set up publisher: %v", err)
+	}
+	pub.Start()
 
 	azureServiceClient, err := azureclient.GetAzureBlobClient(cfg)
 	if err != nil {
 		log.Fatalf("Failed to create blob storage service client")
 	}
 
-	nats.InitStreamAndConsumer(nc, ctx, js, azureServiceClient, cfg)
+	if cfg.MetricsAddr != "" {
+		metricsServer := metrics.Serve(cfg.MetricsAddr)
+		defer metricsServer.Close()
+	}
+
+	setupCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	store, err := idempotency.NewStore(setupCtx, js, cfg.Idempotency)
+	if err != nil {
+		log.Fatalf("Failed to set up idempotency store: %v", err)
+	}
+
+	jobStore, err := jobs.NewStore(setupCtx, js, cfg.Jobs)
+	if err != nil {
+		log.Fatalf("Failed to set up job store: %v", err)
+	}
+	svc, err := nats.AddArtifactService(nc, jobStore, cfg)
+	if err != nil {
+		log.Fatalf("Failed to start artifact service: %v", err)
+	}
 
+	uploader, err := artifact.NewUploader(pub, azureServiceClient, jobStore, cfg)
+	if err != nil {
+		log.Fatalf("Failed to set up uploader: %v", err)
+	}
+	if _, err := nats.SubscribeCancelUpload(nc, uploader, store, jobStore); err != nil {
+		log.Fatalf("Failed to subscribe to upload cancellations: %v", err)
+	}
+
+	limiter := nats.NewLimiter(cfg.Workers.Count, cfg.Workers.PerDomain)
+	router := nats.NewArtifactRouter(pub, azureServiceClient, uploader, store, limiter, cfg)
+	consumer, err := nats.InitStreamAndConsumer(nc, setupCtx, js, pub, router, limiter, jobStore, cfg)
+	if err != nil {
+		log.Fatalf("Failed to start consumer: %v", err)
+	}
+
+	<-ctx.Done()
+	stop()
+	log.Printf("Shutting down, waiting up to %s for in-flight messages", cfg.ShutdownGracePeriod)
+
+	if err := svc.Stop(); err != nil {
+		log.Printf("Failed to stop artifact service: %v", err)
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.ShutdownGracePeriod)
+	defer cancelShutdown()
+
+	if err := consumer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("In-flight messages did not finish: %v", err)
+	}
+	pub.Close()
+
+	if err := nats.Drain(nc, cfg.DrainTimeout); err != nil {
+		log.Printf("Failed to drain NATS connection: %v", err)
+	}
+	log.Print("Shutdown complete")
 }